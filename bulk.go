@@ -0,0 +1,187 @@
+package flexmy
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"strings"
+
+	"git.kanosolution.net/kano/dbflex"
+)
+
+const (
+	// maxPlaceholders is maximum number of ? a prepared statement could have
+	maxPlaceholders = 65535
+
+	// defaultMaxPacket is used when max_allowed_packet of the server can not be read
+	defaultMaxPacket = 4 * 1024 * 1024
+)
+
+// bulkResult is sql.Result of bulk insert, it sums affected rows of all batches
+// and keeps auto increment ID of the first inserted row
+type bulkResult struct {
+	lastInsertID int64
+	rowsAffected int64
+}
+
+// LastInsertId returns auto increment ID of the first inserted row
+func (r *bulkResult) LastInsertId() (int64, error) {
+	return r.lastInsertID, nil
+}
+
+// RowsAffected returns total affected rows of all batches
+func (r *bulkResult) RowsAffected() (int64, error) {
+	return r.rowsAffected, nil
+}
+
+// isBulkData check if data is slice of records, []byte is considered as a single value
+func isBulkData(data interface{}) bool {
+	if data == nil {
+		return false
+	}
+	v := reflect.Indirect(reflect.ValueOf(data))
+	return v.Kind() == reflect.Slice && v.Type().Elem().Kind() != reflect.Uint8
+}
+
+// bulkInsert inserts slice of structs or codekit.M using multi rows INSERT. Rows are split into batches that stay
+// under max_allowed_packet of the server. Batches are not atomic unless the connection is in transaction
+func (q *Query) bulkInsert(data interface{}) (interface{}, error) {
+	tableName := q.Config(dbflex.ConfigKeyTableName, "").(string)
+	rv := reflect.Indirect(reflect.ValueOf(data))
+	result := new(bulkResult)
+	if rv.Len() == 0 {
+		return result, nil
+	}
+
+	// columns are union of fields of every row in order of their first appearance
+	type parsedRow struct {
+		names     []string
+		values    []interface{}
+		sqlvalues []string
+	}
+	fieldnames := []string{}
+	columns := map[string]bool{}
+	rows := make([]parsedRow, rv.Len())
+	for idx := range rows {
+		names, values, sqlvalues := q.affectedFields(q.parseData(rv.Index(idx).Interface()))
+		rows[idx] = parsedRow{names, values, sqlvalues}
+		for _, name := range names {
+			if !columns[strings.ToLower(name)] {
+				columns[strings.ToLower(name)] = true
+				fieldnames = append(fieldnames, name)
+			}
+		}
+	}
+
+	// align fields of every row with the columns, missing field is written as NULL
+	rowValues := make([][]interface{}, len(rows))
+	rowSQLs := make([][]string, len(rows))
+	for idx, row := range rows {
+		positions := map[string]int{}
+		for pos, name := range row.names {
+			positions[strings.ToLower(name)] = pos
+		}
+		alignedValues := make([]interface{}, len(fieldnames))
+		alignedSQLs := make([]string, len(fieldnames))
+		for pos, name := range fieldnames {
+			if from, ok := positions[strings.ToLower(name)]; ok {
+				alignedValues[pos] = row.values[from]
+				alignedSQLs[pos] = row.sqlvalues[from]
+			} else if q.literalSQL {
+				alignedSQLs[pos] = "NULL"
+			} else {
+				alignedSQLs[pos] = "?"
+			}
+		}
+		rowValues[idx] = alignedValues
+		rowSQLs[idx] = alignedSQLs
+	}
+
+	if len(fieldnames) == 0 {
+		return nil, fmt.Errorf("insert operations should have at least one field")
+	}
+
+	maxPacket := defaultMaxPacket
+	if conn, ok := q.Connection().(*Connection); ok {
+		maxPacket = conn.maxAllowedPacket(q.Context())
+	}
+	header := fmt.Sprintf("INSERT INTO %s (%s) VALUES ", tableName, strings.Join(fieldnames, ","))
+	limit := maxPacket*9/10 - len(header)
+
+	tuples := []string{}
+	args := []interface{}{}
+	size := 0
+	flush := func() error {
+		if len(tuples) == 0 {
+			return nil
+		}
+		cmdtxt := header + strings.Join(tuples, ",")
+		r, err := q.exec(cmdtxt, args)
+		if err != nil {
+			if q.literalSQL {
+				return newSQLError(err, cmdtxt)
+			}
+			return newSQLError(err, header+tuples[0]+" ...")
+		}
+		affected, _ := r.RowsAffected()
+		result.rowsAffected += affected
+		if result.lastInsertID == 0 {
+			result.lastInsertID, _ = r.LastInsertId()
+		}
+		tuples = []string{}
+		args = []interface{}{}
+		size = 0
+		return nil
+	}
+
+	for idx, sqlvalues := range rowSQLs {
+		tuple := "(" + strings.Join(sqlvalues, ",") + ")"
+		tupleSize := len(tuple) + 1
+		if !q.literalSQL {
+			tupleSize += argsSize(rowValues[idx])
+		}
+		if len(tuples) > 0 && (size+tupleSize > limit || len(args)+len(fieldnames) > maxPlaceholders) {
+			if err := flush(); err != nil {
+				return result, err
+			}
+		}
+		tuples = append(tuples, tuple)
+		if !q.literalSQL {
+			args = append(args, rowValues[idx]...)
+		}
+		size += tupleSize
+	}
+	if err := flush(); err != nil {
+		return result, err
+	}
+	return result, nil
+}
+
+// argsSize estimates number of bytes args take on the wire
+func argsSize(args []interface{}) int {
+	size := 0
+	for _, arg := range args {
+		switch arg.(type) {
+		case string:
+			size += len(arg.(string)) + 9
+		case []byte:
+			size += len(arg.([]byte)) + 9
+		default:
+			size += 12
+		}
+	}
+	return size
+}
+
+// maxAllowedPacket returns max_allowed_packet of the server, value is cached per connection
+func (c *Connection) maxAllowedPacket(ctx context.Context) int {
+	c.keyLock.Lock()
+	defer c.keyLock.Unlock()
+
+	if c.maxPacket == 0 {
+		if err := c.db.QueryRowContext(ctx, "select @@max_allowed_packet").Scan(&c.maxPacket); err != nil {
+			return defaultMaxPacket
+		}
+	}
+	return c.maxPacket
+}
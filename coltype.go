@@ -0,0 +1,230 @@
+package flexmy
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// columnType is MySQL column type normalized into its canonical name, arguments and unsigned flag,
+// so types written differently by Go mapping, describe and information_schema could be compared
+type columnType struct {
+	Name     string
+	Args     []int
+	Params   string
+	Unsigned bool
+}
+
+var columnTypePattern = regexp.MustCompile(`^\s*([a-z]+(?: precision| varying)?)\s*(?:\(([^)]*)\))?\s*(unsigned)?`)
+
+// typeAliases maps synonyms into the name reported by information_schema
+var typeAliases = map[string]string{
+	"integer":           "int",
+	"real":              "double",
+	"double precision":  "double",
+	"dec":               "decimal",
+	"numeric":           "decimal",
+	"fixed":             "decimal",
+	"character varying": "varchar",
+	"character":         "char",
+	"bool":              "tinyint",
+	"boolean":           "tinyint",
+}
+
+func parseColumnType(dataType string) columnType {
+	ct := columnType{}
+	dataType = strings.ToLower(strings.TrimSpace(dataType))
+	matches := columnTypePattern.FindStringSubmatch(dataType)
+	if matches == nil {
+		ct.Name = dataType
+		return ct
+	}
+
+	ct.Name = matches[1]
+	if alias, ok := typeAliases[ct.Name]; ok {
+		if ct.Name == "bool" || ct.Name == "boolean" {
+			matches[2] = "1"
+		}
+		ct.Name = alias
+	}
+	ct.Unsigned = matches[3] != ""
+	ct.Params = strings.Replace(matches[2], " ", "", -1)
+
+	switch ct.Name {
+	case "enum", "set":
+		return ct
+	}
+	if ct.Params != "" {
+		for _, arg := range strings.Split(ct.Params, ",") {
+			n, _ := strconv.Atoi(arg)
+			ct.Args = append(ct.Args, n)
+		}
+	}
+
+	switch {
+	case integerRanks[ct.Name] > 0:
+		// display width is not part of the type since MySQL 8.0.19, except tinyint(1) used for bool
+		if !(ct.Name == "tinyint" && ct.arg(0, 0) == 1) {
+			ct.Args = nil
+		}
+
+	case ct.Name == "decimal":
+		ct.Args = []int{ct.arg(0, 10), ct.arg(1, 0)}
+
+	case ct.Name == "char" || ct.Name == "binary":
+		ct.Args = []int{ct.arg(0, 1)}
+
+	case ct.Name == "bit":
+		ct.Args = []int{ct.arg(0, 1)}
+
+	case ct.Name == "datetime" || ct.Name == "timestamp" || ct.Name == "time":
+		if ct.arg(0, 0) == 0 {
+			ct.Args = nil
+		}
+
+	case ct.Name == "year", textSizes[ct.Name] > 0, strings.HasSuffix(ct.Name, "blob"), ct.Name == "json":
+		ct.Args = nil
+	}
+	return ct
+}
+
+func (ct columnType) arg(idx int, def int) int {
+	if idx < len(ct.Args) {
+		return ct.Args[idx]
+	}
+	return def
+}
+
+// equal check if both types are the same after normalization
+func (ct columnType) equal(other columnType) bool {
+	if ct.Name != other.Name || ct.Unsigned != other.Unsigned || len(ct.Args) != len(other.Args) {
+		return false
+	}
+	if ct.Name == "enum" || ct.Name == "set" {
+		return ct.Params == other.Params
+	}
+	for idx, arg := range ct.Args {
+		if arg != other.Args[idx] {
+			return false
+		}
+	}
+	return true
+}
+
+// sameColumnType check if MySQL types a and b are the same type written differently
+func sameColumnType(a, b string) bool {
+	return parseColumnType(a).equal(parseColumnType(b))
+}
+
+// existingColumn is column of existing table read from information_schema.COLUMNS
+type existingColumn struct {
+	Name      string
+	Type      string
+	NotNull   bool
+	AutoInc   bool
+	Default   sql.NullString
+	Charset   sql.NullString
+	Collation sql.NullString
+	Comment   string
+}
+
+// existingColumns reads columns of table in their order
+func (c *Connection) existingColumns(ctx context.Context, name string) ([]existingColumn, error) {
+	cmd := "select column_name, column_type, is_nullable, extra, column_default, character_set_name, collation_name, column_comment " +
+		"from information_schema.COLUMNS where table_schema=database() and lower(table_name)=? order by ordinal_position"
+	rows, err := c.db.QueryContext(ctx, cmd, strings.ToLower(name))
+	if err != nil {
+		return nil, fmt.Errorf("unable to read columns of %s. %s", name, err.Error())
+	}
+	defer rows.Close()
+
+	columns := []existingColumn{}
+	for rows.Next() {
+		col := existingColumn{}
+		nullable, extra := "", ""
+		if err = rows.Scan(&col.Name, &col.Type, &nullable, &extra, &col.Default, &col.Charset, &col.Collation, &col.Comment); err != nil {
+			return nil, fmt.Errorf("unable to read columns of %s. %s", name, err.Error())
+		}
+		extra = strings.ToLower(extra)
+		col.NotNull = nullable == "NO"
+		col.AutoInc = strings.Contains(extra, "auto_increment")
+		columns = append(columns, col)
+	}
+	return columns, rows.Err()
+}
+
+// normalizeDefault returns default value comparable between tag and information_schema,
+// quotes and parentheses of expression are removed and current timestamp synonyms are unified
+func normalizeDefault(v string) string {
+	v = strings.TrimSpace(v)
+	for len(v) >= 2 && ((v[0] == '\'' && v[len(v)-1] == '\'') || (v[0] == '(' && v[len(v)-1] == ')')) {
+		v = strings.TrimSpace(v[1 : len(v)-1])
+	}
+	v = strings.ToLower(v)
+	for _, synonym := range []string{"now", "current_timestamp", "localtime", "localtimestamp"} {
+		if v == synonym || strings.HasPrefix(v, synonym+"(") {
+			return "current_timestamp" + strings.TrimPrefix(strings.TrimPrefix(v, synonym), "()")
+		}
+	}
+	return v
+}
+
+// normalizeCharset unifies utf8 alias reported as utf8mb3 by newer server
+func normalizeCharset(v string) string {
+	v = strings.ToLower(strings.TrimSpace(v))
+	if v == "utf8" {
+		return "utf8mb3"
+	}
+	return strings.Replace(v, "utf8_", "utf8mb3_", 1)
+}
+
+// columnDiffs returns differences of existing column and declared one, empty when they are the same
+func columnDiffs(existing existingColumn, col columnSpec) []string {
+	diffs := []string{}
+	if !sameColumnType(existing.Type, col.DataType) {
+		diffs = append(diffs, fmt.Sprintf("type %s into %s", existing.Type, col.DataType))
+	}
+	if existing.NotNull != col.notNull() {
+		diffs = append(diffs, fmt.Sprintf("not null %t into %t", existing.NotNull, col.notNull()))
+	}
+	if existing.AutoInc != col.Tag.AutoInc {
+		diffs = append(diffs, fmt.Sprintf("auto increment %t into %t", existing.AutoInc, col.Tag.AutoInc))
+	}
+	if col.Tag.HasDefault {
+		current := "null"
+		if existing.Default.Valid {
+			current = normalizeDefault(existing.Default.String)
+		}
+		if current != normalizeDefault(col.Tag.Default) {
+			diffs = append(diffs, fmt.Sprintf("default %s into %s", current, col.Tag.Default))
+		}
+	}
+	if col.Tag.Charset != "" && normalizeCharset(existing.Charset.String) != normalizeCharset(col.Tag.Charset) {
+		diffs = append(diffs, fmt.Sprintf("charset %s into %s", existing.Charset.String, col.Tag.Charset))
+	}
+	if col.Tag.Collate != "" && normalizeCharset(existing.Collation.String) != normalizeCharset(col.Tag.Collate) {
+		diffs = append(diffs, fmt.Sprintf("collation %s into %s", existing.Collation.String, col.Tag.Collate))
+	}
+	if col.Tag.Comment != "" && existing.Comment != col.Tag.Comment {
+		diffs = append(diffs, "comment")
+	}
+	return diffs
+}
+
+// isLossyColumnChange check if altering existing column into col could lose or reject existing data
+func isLossyColumnChange(existing existingColumn, col columnSpec) bool {
+	if !sameColumnType(existing.Type, col.DataType) && !isWidening(existing.Type, col.DataType) {
+		return true
+	}
+	if col.notNull() && !existing.NotNull {
+		return true
+	}
+	if col.Tag.Charset != "" && normalizeCharset(existing.Charset.String) != normalizeCharset(col.Tag.Charset) &&
+		normalizeCharset(col.Tag.Charset) != "utf8mb4" {
+		return true
+	}
+	return false
+}
@@ -1,11 +1,14 @@
 package flexmy
 
 import (
+	"context"
 	"database/sql"
 	"errors"
 	"fmt"
 	"reflect"
 	"strings"
+	"sync"
+	"time"
 
 	"git.kanosolution.net/kano/dbflex"
 
@@ -17,8 +20,19 @@ import (
 // Connection implementation of dbflex.IConnection
 type Connection struct {
 	rdbms.Connection
-	db *sql.DB
-	tx *sql.Tx
+	db       *sql.DB
+	tx       *sql.Tx
+	txConnID int64
+	txLevel  int
+
+	txIsolation sql.IsolationLevel
+
+	keyLock   sync.Mutex
+	tableKeys map[string][][]string
+	maxPacket int
+
+	migrationLock sync.Mutex
+	migrations    []Migration
 }
 
 func init() {
@@ -39,6 +53,9 @@ func (c *Connection) Connect() error {
 	configs := strings.Join(func() []string {
 		var out []string
 		for k, v := range c.Config {
+			if isDriverConfig(k) {
+				continue
+			}
 			out = append(out, fmt.Sprintf("%s=%s", k, v))
 		}
 		return out
@@ -51,6 +68,14 @@ func (c *Connection) Connect() error {
 	return err
 }
 
+// ConnectContext connect to database instance and make sure the server is reachable before ctx is done
+func (c *Connection) ConnectContext(ctx context.Context) error {
+	if err := c.Connect(); err != nil {
+		return err
+	}
+	return c.db.PingContext(ctx)
+}
+
 func (c *Connection) State() string {
 	if c.db != nil {
 		return dbflex.StateConnected
@@ -71,21 +96,110 @@ func (c *Connection) NewQuery() dbflex.IQuery {
 	q.SetThis(q)
 	q.db = c.db
 	q.tx = c.tx
+	q.txConnID = c.txConnID
+	q.literalSQL = configBool(c.Config[ConfigLiteralSQL])
+	q.guessType = configBool(c.Config[ConfigGuessType])
+	q.storeLoc = c.storeLocation()
+	q.timePrecision = c.timePrecision()
 	return q
 }
 
+// CursorContext is Cursor that runs its command under ctx. Cancelling ctx kills the running query on the server
+func (c *Connection) CursorContext(ctx context.Context, cmd dbflex.ICommand, in codekit.M) dbflex.ICursor {
+	q, err := c.Prepare(cmd)
+	if err != nil {
+		cursor := new(Cursor)
+		cursor.SetThis(cursor)
+		cursor.SetError(err)
+		return cursor
+	}
+	if mq, ok := q.(*Query); ok {
+		mq.SetContext(ctx)
+	}
+	return q.Cursor(in)
+}
+
+// ExecuteContext is Execute that runs its command under ctx. Cancelling ctx kills the running command on the server
+func (c *Connection) ExecuteContext(ctx context.Context, cmd dbflex.ICommand, in codekit.M) (interface{}, error) {
+	q, err := c.Prepare(cmd)
+	if err != nil {
+		return nil, err
+	}
+	if mq, ok := q.(*Query); ok {
+		mq.SetContext(ctx)
+	}
+	return q.Execute(in)
+}
+
 // DropTable - delete table
 func (c *Connection) DropTable(name string) error {
+	c.resetUniqueKeys(name)
 	_, err := c.db.Exec("drop table if exists " + name)
 	return err
 }
 
 // EnsureTable ensure existence and structures of the table
 func (c *Connection) EnsureTable(name string, keys []string, obj interface{}) error {
+	return c.EnsureTableContext(context.Background(), name, keys, obj)
+}
+
+// EnsureTableContext is EnsureTable that runs its commands under ctx
+func (c *Connection) EnsureTableContext(ctx context.Context, name string, keys []string, obj interface{}) error {
+	_, err := c.EnsureTableWithOptions(ctx, name, keys, obj, nil)
+	return err
+}
+
+// EnsureTableWithOptions creates table or alters its columns and secondary indexes to match obj.
+// Indexes are declared by TagName tag or opts, stale ones are reported in the result unless they are asked to be dropped.
+// Lossy changes are refused when ConfigRefuseLossy or opts.RefuseLossy is set, unless opts.AllowLossy is set.
+// opts.Online alters existing table without blocking writes, see OnlineMode
+func (c *Connection) EnsureTableWithOptions(ctx context.Context, name string, keys []string, obj interface{}, opts *TableOptions) (*TableResult, error) {
+	if opts == nil {
+		opts = new(TableOptions)
+	}
+	c.resetUniqueKeys(name)
+	result := new(TableResult)
+
+	plan, err := c.PlanTableWithOptions(ctx, name, keys, obj, opts)
+	if err != nil {
+		return result, err
+	}
+	result.StaleIndexes = plan.StaleIndexes
+	result.StaleForeignKeys = plan.StaleForeignKeys
+	result.StaleColumns = plan.StaleColumns
+
+	refuseLossy := opts.RefuseLossy || configBool(c.Config[ConfigRefuseLossy])
+	if refuseLossy && !opts.AllowLossy && len(plan.Lossy()) > 0 {
+		return result, lossyError(plan)
+	}
+
+	if len(plan.Changes) == 0 {
+		return result, nil
+	}
+
+	if !plan.Create && opts.Online != OnlineOff {
+		err = c.alterOnline(ctx, plan, opts, result)
+		return result, err
+	}
+
+	for _, sql := range plan.Statements() {
+		_, err = c.db.ExecContext(ctx, sql)
+		if err != nil {
+			if plan.Create {
+				return result, fmt.Errorf("unable to created table %s. %s", name, err.Error())
+			}
+			return result, fmt.Errorf("unable to alter table %s. %s", name, err.Error())
+		}
+		result.Commands = append(result.Commands, sql)
+	}
+	return result, nil
+}
+
+func (c *Connection) tableExists(ctx context.Context, name string) (bool, error) {
 	cmd := fmt.Sprintf("select table_name from information_schema.TABLES t where table_type='BASE TABLE' and table_name='%s'", strings.ToLower(name))
-	rs, err := c.db.Query(cmd)
+	rs, err := c.db.QueryContext(ctx, cmd)
 	if err != nil {
-		return fmt.Errorf("unable to check table existence. %s", err.Error())
+		return false, fmt.Errorf("unable to check table existence. %s", err.Error())
 	}
 	defer rs.Close()
 
@@ -95,160 +209,505 @@ func (c *Connection) EnsureTable(name string, keys []string, obj interface{}) er
 		rs.Scan(&tbname)
 		tableExists = strings.ToLower(tbname) == strings.ToLower(name)
 	}
+	return tableExists, nil
+}
 
-	if !tableExists {
-		cmd := createCommandForCreate(name, keys, obj)
-		_, err = c.db.Exec(cmd)
-		if err != nil {
-			return fmt.Errorf("unable to created table %s. %s", name, err.Error())
+// uniqueKeys returns lowercased columns of primary and unique keys of table. Result is cached per connection
+func (c *Connection) uniqueKeys(ctx context.Context, name string) ([][]string, error) {
+	c.keyLock.Lock()
+	defer c.keyLock.Unlock()
+
+	tablename := strings.ToLower(name)
+	if keys, ok := c.tableKeys[tablename]; ok {
+		return keys, nil
+	}
+
+	cmd := "select index_name, column_name from information_schema.STATISTICS " +
+		"where table_schema=database() and lower(table_name)=? and non_unique=0 order by index_name, seq_in_index"
+	rows, err := c.db.QueryContext(ctx, cmd, tablename)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	keys := [][]string{}
+	lastIndex := ""
+	for rows.Next() {
+		indexName, columnName := "", ""
+		if err = rows.Scan(&indexName, &columnName); err != nil {
+			return nil, err
 		}
-	} else {
-		sql := createCommandForUpdate(name, keys, obj, c)
-		if sql != "" {
-			_, err = c.db.Exec(sql)
-			if err != nil {
-				return fmt.Errorf("unable to alter table %s. %s", name, err.Error())
-			}
+		if indexName != lastIndex || len(keys) == 0 {
+			keys = append(keys, []string{})
+			lastIndex = indexName
 		}
+		keys[len(keys)-1] = append(keys[len(keys)-1], strings.ToLower(columnName))
 	}
-	return nil
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	if c.tableKeys == nil {
+		c.tableKeys = map[string][][]string{}
+	}
+	c.tableKeys[tablename] = keys
+	return keys, nil
 }
 
-func createCommandForCreate(name string, keys []string, obj interface{}) string {
-	v := reflect.Indirect(reflect.ValueOf(obj))
-	t := v.Type()
+func (c *Connection) resetUniqueKeys(name string) {
+	c.keyLock.Lock()
+	defer c.keyLock.Unlock()
+	delete(c.tableKeys, strings.ToLower(name))
+}
 
-	cmd := "CREATE TABLE %s (\n%s\n)"
-	fieldNum := v.NumField()
-	fields := []string{}
-	for idx := 0; idx < fieldNum; idx++ {
-		ft := t.Field(idx)
-		alias := ft.Tag.Get(codekit.TagName())
-		if alias == "-" {
-			continue
+// keyCovers check if any of keys has all of its columns within fields
+func keyCovers(keys [][]string, fields []string) bool {
+	if len(fields) == 0 {
+		return false
+	}
+	for _, key := range keys {
+		covered := len(key) > 0
+		for _, column := range key {
+			if !codekit.HasMember(fields, column) {
+				covered = false
+				break
+			}
 		}
-		fieldName := ft.Name
-		if alias != "" {
-			fieldName = alias
+		if covered {
+			return true
 		}
-		ftName := strings.ToLower(ft.Name)
-		dataType := getDataType(ftName)
-		ftxt := fmt.Sprintf("%s %s", fieldName, dataType)
-		if codekit.HasMember(keys, fieldName) {
-			ftxt = ftxt + " NOT NULL PRIMARY KEY"
+	}
+	return false
+}
+
+func createCommandForCreate(spec *tableSpec) string {
+	cmd := "CREATE TABLE %s (\n%s\n)"
+	fields := []string{}
+	primaryKeys := []string{}
+	for _, col := range spec.Columns {
+		fields = append(fields, fmt.Sprintf("%s %s", col.Name, col.definition()))
+		if col.IsKey {
+			primaryKeys = append(primaryKeys, col.Name)
 		}
-		fields = append(fields, ftxt)
 	}
-	cmd = fmt.Sprintf(cmd, name, strings.Join(fields, ",\n"))
+	if len(primaryKeys) > 0 {
+		fields = append(fields, fmt.Sprintf("PRIMARY KEY (%s)", strings.Join(primaryKeys, ",")))
+	}
+	for _, ix := range spec.Indexes {
+		fields = append(fields, ix.definition())
+	}
+	for _, fk := range spec.ForeignKeys {
+		fields = append(fields, fk.definition())
+	}
+	cmd = fmt.Sprintf(cmd, spec.Name, strings.Join(fields, ",\n"))
 	return cmd
 }
 
-func createCommandForUpdate(name string, keys []string, obj interface{}, c *Connection) string {
+// createCommandForUpdate returns plan of altering existing table into spec
+func createCommandForUpdate(ctx context.Context, spec *tableSpec, opts *TableOptions, c *Connection) (*TablePlan, error) {
 	// get all fields from existing
-	type fieldMeta struct {
-		Field   string
-		Type    string
-		Null    string
-		Key     string
-		Default string
-		Extra   string
-	}
-
-	fields := map[string]fieldMeta{}
-	describe := "describe " + name
-	rows, _ := c.db.Query(describe)
-	for rows.Next() {
-		f := fieldMeta{}
-		rows.Scan(&(f.Field), &(f.Type), &(f.Null), &(f.Key), &(f.Default), &(f.Extra))
-		fields[f.Field] = f
+	columns, err := c.existingColumns(ctx, spec.Name)
+	if err != nil {
+		return nil, err
+	}
+	fields := map[string]existingColumn{}
+	existingColumns := []string{}
+	for _, f := range columns {
+		fields[f.Name] = f
+		existingColumns = append(existingColumns, f.Name)
 	}
-	//fmt.Println(fields)
-
-	v := reflect.Indirect(reflect.ValueOf(obj))
-	t := v.Type()
 
-	cmds := []string{}
+	plan := &TablePlan{Name: spec.Name, renames: map[string]string{}}
+	existingKeys, err := c.tableForeignKeys(ctx, spec.Name)
+	if err != nil {
+		return nil, err
+	}
+	foreignKeyDrops(plan, spec.ForeignKeys, existingKeys, opts.DropStaleForeignKeys)
 
-	fieldNum := t.NumField()
-	for idx := 0; idx < fieldNum; idx++ {
-		ft := t.Field(idx)
-		fieldName := ft.Name
-		alias := ft.Tag.Get(codekit.TagName())
-		if alias == "-" {
+	// renamed field keeps data of its old column, it is renamed ahead of other changes
+	columnNames := map[string]bool{}
+	for _, col := range spec.Columns {
+		columnNames[col.Name] = true
+	}
+	for _, col := range spec.Columns {
+		meta, hasOld := fields[col.Tag.Was]
+		if _, hasField := fields[col.Name]; hasField || !hasOld || columnNames[col.Tag.Was] {
 			continue
 		}
-		if alias != "" {
-			fieldName = alias
+		plan.addChange(ChangeSafe, fmt.Sprintf("rename column %s to %s", col.Tag.Was, col.Name),
+			fmt.Sprintf("rename column %s to %s", col.Tag.Was, col.Name), true)
+		plan.renames[col.Name] = col.Tag.Was
+		delete(fields, col.Tag.Was)
+		meta.Name = col.Name
+		fields[col.Name] = meta
+		for idx, name := range existingColumns {
+			if name == col.Tag.Was {
+				existingColumns[idx] = col.Name
+			}
+		}
+	}
+
+	// order of existing columns of the struct, it is kept along the changes to find columns out of place
+	ordered := []string{}
+	for _, name := range existingColumns {
+		if columnNames[name] {
+			ordered = append(ordered, name)
+		}
+	}
+
+	for idx, col := range spec.Columns {
+		columnDef := col.definition()
+		position := "FIRST"
+		if idx > 0 {
+			position = "AFTER " + spec.Columns[idx-1].Name
 		}
 
-		dataType := getDataType(ft.Type.Name())
-		columnDef := fmt.Sprintf("%s", dataType)
-		meta, hasField := fields[fieldName]
+		meta, hasField := fields[col.Name]
 		if !hasField {
-			cmd := fmt.Sprintf("add %s %s", fieldName, columnDef)
-			cmds = append(cmds, cmd)
-		} else if dataType != meta.Type {
-			cmd := fmt.Sprintf("modify %s %s", fieldName, columnDef)
-			cmds = append(cmds, cmd)
+			plan.addChange(ChangeSafe, fmt.Sprintf("add %s %s %s", col.Name, columnDef, position), "add column "+col.Name, false)
+			ordered = insertName(ordered, idx, col.Name)
+			continue
+		}
+
+		moved := opts.ReorderColumns && (idx >= len(ordered) || ordered[idx] != col.Name)
+		if moved {
+			ordered = insertName(removeName(ordered, col.Name), idx, col.Name)
+		}
+
+		diffs := columnDiffs(meta, col)
+		changed := len(diffs) > 0
+		if !changed && !moved {
+			continue
+		}
+
+		kind := ChangeSafe
+		if changed && isLossyColumnChange(meta, col) {
+			kind = ChangeLossy
 		}
+		clause := fmt.Sprintf("modify %s %s", col.Name, columnDef)
+		detail := fmt.Sprintf("modify column %s %s", col.Name, strings.Join(diffs, ", "))
+		if moved {
+			clause += " " + position
+			if !changed {
+				detail = fmt.Sprintf("move column %s %s", col.Name, position)
+			}
+		}
+		plan.addChange(kind, clause, detail, false)
 	}
 
-	if len(cmds) > 0 {
-		sql := fmt.Sprintf("alter table %s ", name)
-		sql += strings.Join(cmds, ", ")
-		return sql
-		//fmt.Println(sql)
+	for _, name := range existingColumns {
+		if columnNames[name] {
+			continue
+		}
+		plan.StaleColumns = append(plan.StaleColumns, name)
+		if opts.DropColumns {
+			plan.addChange(ChangeLossy, "drop column "+name, "drop column "+name, false)
+		}
 	}
 
-	return ""
+	// index backing a foreign key is named after its constraint, it is managed along with the constraint
+	fkNames := map[string]bool{}
+	for _, fk := range append(existingKeys, spec.ForeignKeys...) {
+		fkNames[strings.ToLower(fk.Name)] = true
+	}
+	existingIndexes, err := c.tableIndexes(ctx, spec.Name)
+	if err != nil {
+		return nil, err
+	}
+	indexes := []Index{}
+	for _, ix := range existingIndexes {
+		if !fkNames[strings.ToLower(ix.Name)] {
+			indexes = append(indexes, ix)
+		}
+	}
+	indexChanges(plan, spec.Indexes, indexes, opts.DropStaleIndexes)
+	foreignKeyAdds(plan, spec.ForeignKeys, existingKeys)
+
+	return plan, nil
+}
+
+// columnName returns column name of struct field, alias given by codekit.TagName() tag takes precedence.
+// "-" means the field is not stored
+func columnName(ft reflect.StructField) string {
+	if alias := ft.Tag.Get(codekit.TagName()); alias != "" {
+		return alias
+	}
+	return ft.Name
+}
+
+// integerTypes maps Go integer kinds into MySQL integer types of the same width
+var integerTypes = map[reflect.Kind]string{
+	reflect.Int8:   "tinyint",
+	reflect.Int16:  "smallint",
+	reflect.Int32:  "int",
+	reflect.Int64:  "bigint",
+	reflect.Int:    "bigint",
+	reflect.Uint8:  "tinyint unsigned",
+	reflect.Uint16: "smallint unsigned",
+	reflect.Uint32: "int unsigned",
+	reflect.Uint64: "bigint unsigned",
+	reflect.Uint:   "bigint unsigned",
+}
+
+func getDataType(ft reflect.Type, timeType string) string {
+	for ft.Kind() == reflect.Ptr {
+		ft = ft.Elem()
+	}
+
+	switch ft.String() {
+	case "flexmy.Decimal", "big.Rat":
+		return "decimal(38,10)"
+	case "sql.NullInt64":
+		return "bigint"
+	case "sql.NullInt32":
+		return "int"
+	case "sql.NullFloat64":
+		return "double"
+	case "sql.NullBool":
+		return "tinyint(1)"
+	case "sql.NullTime":
+		return timeType
+	}
+
+	if dataType, ok := integerTypes[ft.Kind()]; ok {
+		return dataType
+	}
+	if ft.Kind() == reflect.Float32 || ft.Kind() == reflect.Float64 {
+		return "double"
+	}
+
+	if isJSONType(ft) {
+		return "json"
+	}
+
+	if ft == reflect.TypeOf(time.Time{}) {
+		return timeType
+	}
+	if ft.Kind() == reflect.Bool {
+		return "tinyint(1)"
+	}
+	return "varchar(200)"
 }
 
-func getDataType(ftName string) string {
-	dataType := "varchar(200)"
-	if strings.HasPrefix(ftName, "int") {
-		dataType = "int"
-	} else if strings.HasPrefix(ftName, "float") {
-		dataType = "real"
-	} else if strings.HasPrefix(ftName, "time") {
-		dataType = "datetime"
-	} else if strings.HasPrefix(ftName, "bool") {
-		dataType = "tinyint(1)"
+// isJSONType check if field of type ft is stored as JSON document: map, slice other than []byte and struct
+// other than time and sql.Null*
+func isJSONType(ft reflect.Type) bool {
+	switch ft.Kind() {
+	case reflect.Map:
+		return true
+	case reflect.Slice, reflect.Array:
+		return ft.Elem().Kind() != reflect.Uint8
+	case reflect.Struct:
+		name := ft.String()
+		return name != "time.Time" && name != "big.Rat" && !strings.HasPrefix(name, "sql.Null")
 	}
-	return dataType
+	return false
 }
 
 func (c *Connection) BeginTx() error {
+	return c.BeginTxContext(context.Background())
+}
+
+// BeginTxContext begins transaction bound to ctx. When ctx is done transaction will be rolled back
+// and running command inside it will be killed on the server.
+// Calling it while already in transaction creates a savepoint, nested level is committed or rolled back
+// by the next Commit or RollBack
+func (c *Connection) BeginTxContext(ctx context.Context) error {
+	return c.BeginTxWithOptions(ctx, nil)
+}
+
+// TxOptions is option of a transaction
+type TxOptions struct {
+	// Isolation level of transaction, sql.LevelDefault uses session level of the server
+	Isolation sql.IsolationLevel
+
+	// ReadOnly starts transaction with READ ONLY access mode
+	ReadOnly bool
+
+	// ConsistentSnapshot starts transaction WITH CONSISTENT SNAPSHOT, so snapshot is taken when transaction begins
+	// instead of on the first read. It is only meaningful with REPEATABLE READ isolation
+	ConsistentSnapshot bool
+}
+
+var isolationNames = map[sql.IsolationLevel]string{
+	sql.LevelReadUncommitted: "READ UNCOMMITTED",
+	sql.LevelReadCommitted:   "READ COMMITTED",
+	sql.LevelRepeatableRead:  "REPEATABLE READ",
+	sql.LevelSerializable:    "SERIALIZABLE",
+}
+
+// BeginTxWithOptions begins transaction bound to ctx using opts. Options can not be applied to nested level
+func (c *Connection) BeginTxWithOptions(ctx context.Context, opts *TxOptions) error {
 	if c.IsTx() {
-		return errors.New("already in transaction mode. Please commit or rollback first")
+		if opts != nil {
+			return errors.New("transaction options can not be applied to nested transaction")
+		}
+		savepoint := fmt.Sprintf("sp_%d", c.txLevel)
+		if _, e := c.tx.ExecContext(ctx, "SAVEPOINT "+savepoint); e != nil {
+			return fmt.Errorf("unable to create savepoint %s. %s", savepoint, e.Error())
+		}
+		c.txLevel++
+		return nil
+	}
+
+	if opts == nil {
+		opts = new(TxOptions)
+	}
+	isolationName, validIsolation := isolationNames[opts.Isolation]
+	if opts.Isolation != sql.LevelDefault && !validIsolation {
+		return fmt.Errorf("isolation level %s is not supported", opts.Isolation.String())
+	}
+
+	if opts.ConsistentSnapshot {
+		tx, e := c.beginSnapshot(ctx, opts, isolationName)
+		if e != nil {
+			return e
+		}
+		return c.startTx(ctx, tx, opts.Isolation)
 	}
-	tx, e := c.db.Begin()
+
+	tx, e := c.db.BeginTx(ctx, &sql.TxOptions{Isolation: opts.Isolation, ReadOnly: opts.ReadOnly})
 	if e != nil {
 		return e
 	}
+	return c.startTx(ctx, tx, opts.Isolation)
+}
+
+// beginSnapshot begins transaction WITH CONSISTENT SNAPSHOT. database/sql could not start it, so the transaction
+// begun by the driver is restarted on the same connection. Isolation level is given to the restarted transaction
+// by session level, which is restored right after as it does not affect the already started transaction
+func (c *Connection) beginSnapshot(ctx context.Context, opts *TxOptions, isolationName string) (*sql.Tx, error) {
+	tx, e := c.db.BeginTx(ctx, nil)
+	if e != nil {
+		return nil, e
+	}
+
+	cmds := []string{}
+	restore := func() {}
+	if isolationName != "" {
+		sessionLevel := ""
+		if e = tx.QueryRowContext(ctx, "select @@session.transaction_isolation").Scan(&sessionLevel); e != nil {
+			// MySQL before 5.7.20 only has tx_isolation
+			if e = tx.QueryRowContext(ctx, "select @@session.tx_isolation").Scan(&sessionLevel); e != nil {
+				tx.Rollback()
+				return nil, fmt.Errorf("unable to read session isolation level. %s", e.Error())
+			}
+		}
+		sessionLevel = strings.Replace(strings.ToUpper(sessionLevel), "-", " ", -1)
+		cmds = append(cmds, "SET SESSION TRANSACTION ISOLATION LEVEL "+isolationName)
+		restore = func() {
+			tx.ExecContext(context.Background(), "SET SESSION TRANSACTION ISOLATION LEVEL "+sessionLevel)
+		}
+	}
+
+	start := "START TRANSACTION WITH CONSISTENT SNAPSHOT"
+	if opts.ReadOnly {
+		start += ", READ ONLY"
+	}
+	cmds = append(cmds, start)
+	for _, cmd := range cmds {
+		if _, e = tx.ExecContext(ctx, cmd); e != nil {
+			restore()
+			tx.Rollback()
+			return nil, fmt.Errorf("unable to start consistent snapshot. %s", e.Error())
+		}
+	}
+	restore()
+	return tx, nil
+}
+
+// startTx makes tx the active transaction of the connection
+func (c *Connection) startTx(ctx context.Context, tx *sql.Tx, isolation sql.IsolationLevel) error {
+	// connection id is kept for every transaction, so commands run by ExecuteContext and CursorContext could be killed
+	var connID int64
+	if e := tx.QueryRowContext(ctx, "select connection_id()").Scan(&connID); e != nil {
+		tx.Rollback()
+		return e
+	}
 	c.tx = tx
+	c.txConnID = connID
+	c.txLevel = 1
+	c.txIsolation = isolation
 	return nil
 }
 
+// IsolationLevel returns isolation level of active transaction. When transaction is started with default level,
+// the level is read from the server
+func (c *Connection) IsolationLevel() (sql.IsolationLevel, error) {
+	if !c.IsTx() {
+		return sql.LevelDefault, fmt.Errorf("not is transaction mode")
+	}
+	if c.txIsolation != sql.LevelDefault {
+		return c.txIsolation, nil
+	}
+
+	name := ""
+	if e := c.tx.QueryRow("select @@transaction_isolation").Scan(&name); e != nil {
+		// MySQL before 5.7.20 only has tx_isolation
+		if e = c.tx.QueryRow("select @@tx_isolation").Scan(&name); e != nil {
+			return sql.LevelDefault, e
+		}
+	}
+	name = strings.Replace(strings.ToUpper(name), "-", " ", -1)
+	for level, levelName := range isolationNames {
+		if levelName == name {
+			c.txIsolation = level
+			return level, nil
+		}
+	}
+	return sql.LevelDefault, fmt.Errorf("unknown isolation level %s", name)
+}
+
+// Commit commits the transaction. On nested level it releases the innermost savepoint instead
 func (c *Connection) Commit() error {
 	if !c.IsTx() {
 		return fmt.Errorf("not is transaction mode")
 	}
-	if e := c.tx.Commit(); e != nil {
-		return e
+	if c.txLevel > 1 {
+		savepoint := fmt.Sprintf("sp_%d", c.txLevel-1)
+		if _, e := c.tx.Exec("RELEASE SAVEPOINT " + savepoint); e != nil {
+			return fmt.Errorf("unable to release savepoint %s. %s", savepoint, e.Error())
+		}
+		c.txLevel--
+		return nil
 	}
-	c.tx = nil
-	return nil
+	// sql.Tx is done after Commit regardless of its result
+	e := c.tx.Commit()
+	c.endTx()
+	return e
 }
 
+// RollBack rolls back the transaction. On nested level it rolls back to the innermost savepoint instead
 func (c *Connection) RollBack() error {
 	if !c.IsTx() {
 		return fmt.Errorf("not is transaction mode")
 	}
-	if e := c.tx.Rollback(); e != nil {
-		return e
+	if c.txLevel > 1 {
+		savepoint := fmt.Sprintf("sp_%d", c.txLevel-1)
+		if _, e := c.tx.Exec("ROLLBACK TO SAVEPOINT " + savepoint); e != nil {
+			return fmt.Errorf("unable to rollback to savepoint %s. %s", savepoint, e.Error())
+		}
+		if _, e := c.tx.Exec("RELEASE SAVEPOINT " + savepoint); e != nil {
+			return fmt.Errorf("unable to release savepoint %s. %s", savepoint, e.Error())
+		}
+		c.txLevel--
+		return nil
 	}
+	e := c.tx.Rollback()
+	c.endTx()
+	return e
+}
+
+func (c *Connection) endTx() {
 	c.tx = nil
-	return nil
+	c.txConnID = 0
+	c.txLevel = 0
+	c.txIsolation = sql.LevelDefault
+}
+
+// TxLevel returns nesting level of transaction, 0 means not in transaction
+func (c *Connection) TxLevel() int {
+	return c.txLevel
 }
 
 func (c *Connection) SupportTx() bool {
@@ -262,3 +721,49 @@ func (c *Connection) IsTx() bool {
 func (c *Connection) Tx() *sql.Tx {
 	return c.tx
 }
+
+// DB returns underlying connection pool, ie to run raw statement from a Go migration
+func (c *Connection) DB() *sql.DB {
+	return c.db
+}
+
+// dedicatedConn get a connection from pool and its server side connection id
+func dedicatedConn(ctx context.Context, db *sql.DB) (*sql.Conn, int64, error) {
+	conn, err := db.Conn(ctx)
+	if err != nil {
+		return nil, 0, err
+	}
+	var connID int64
+	if err = conn.QueryRowContext(ctx, "select connection_id()").Scan(&connID); err != nil {
+		conn.Close()
+		return nil, 0, err
+	}
+	return conn, connID, nil
+}
+
+// watchKill issues KILL QUERY for connID once ctx is done, until returned stop func is called.
+// stop waits for the watcher to exit, so no KILL is sent after it returns and the connection could be reused safely
+func watchKill(ctx context.Context, db *sql.DB, connID int64) func() {
+	if ctx.Done() == nil || connID == 0 {
+		return func() {}
+	}
+	done := make(chan struct{})
+	exited := make(chan struct{})
+	go func() {
+		defer close(exited)
+		select {
+		case <-ctx.Done():
+			select {
+			case <-done:
+				// command has finished at the same time
+			default:
+				db.Exec(fmt.Sprintf("KILL QUERY %d", connID))
+			}
+		case <-done:
+		}
+	}()
+	return func() {
+		close(done)
+		<-exited
+	}
+}
@@ -1,10 +1,17 @@
 package flexmy
 
 import (
+	"database/sql"
+	"encoding/json"
 	"errors"
+	"fmt"
+	"io"
+	"reflect"
+	"strconv"
 	"strings"
 	"time"
 
+	"git.kanosolution.net/kano/dbflex"
 	"git.kanosolution.net/kano/dbflex/drivers/rdbms"
 	"github.com/sebarcode/codekit"
 )
@@ -12,12 +19,314 @@ import (
 // Cursor represent cursor object. Inherits Cursor object of rdbms drivers and implementation of dbflex.ICursor
 type Cursor struct {
 	rdbms.Cursor
+	rows        *sql.Rows
+	columnTypes []*sql.ColumnType
+	guessType   bool
+	loc         *time.Location
 }
 
+// setRows keeps rows and their column types, column type decodes values when target type is unknown
+func (c *Cursor) setRows(rows *sql.Rows) {
+	c.rows = rows
+	if cts, err := rows.ColumnTypes(); err == nil {
+		c.columnTypes = cts
+	}
+	c.SetFetcher(rows)
+}
+
+// Fetch reads next row into obj, a pointer of struct or codekit.M. io.EOF is set as error after the last row
+func (c *Cursor) Fetch(obj interface{}) dbflex.ICursor {
+	if c.Error() != nil {
+		return c
+	}
+	if c.rows == nil {
+		c.SetError(errors.New("cursor has no rows"))
+		return c
+	}
+
+	dest := reflect.ValueOf(obj)
+	if dest.Kind() != reflect.Ptr || dest.IsNil() {
+		c.SetError(fmt.Errorf("fetch needs a pointer, got %T", obj))
+		return c
+	}
+
+	if !c.rows.Next() {
+		if err := c.rows.Err(); err != nil {
+			c.SetError(err)
+		} else {
+			c.SetError(io.EOF)
+		}
+		return c
+	}
+	if err := c.scanRow(dest.Elem()); err != nil {
+		c.SetError(err)
+	}
+	return c
+}
+
+// Fetchs reads n rows into result, a pointer of slice. n=0 reads every remaining row
+func (c *Cursor) Fetchs(result interface{}, n int) error {
+	if c.Error() != nil {
+		return c.Error()
+	}
+	if c.rows == nil {
+		return errors.New("cursor has no rows")
+	}
+
+	dest := reflect.ValueOf(result)
+	if dest.Kind() != reflect.Ptr || dest.Elem().Kind() != reflect.Slice {
+		return fmt.Errorf("fetchs needs a pointer of slice, got %T", result)
+	}
+
+	sliceType := dest.Elem().Type()
+	elemType := sliceType.Elem()
+	items := reflect.MakeSlice(sliceType, 0, 0)
+	for read := 0; n == 0 || read < n; read++ {
+		if !c.rows.Next() {
+			break
+		}
+		item := reflect.New(elemType).Elem()
+		if elemType.Kind() == reflect.Ptr {
+			item.Set(reflect.New(elemType.Elem()))
+		}
+		if err := c.scanRow(reflect.Indirect(item)); err != nil {
+			return err
+		}
+		items = reflect.Append(items, item)
+	}
+	if err := c.rows.Err(); err != nil {
+		return err
+	}
+	dest.Elem().Set(items)
+	return nil
+}
+
+// scanRow decodes current row into dest, a struct or a map. Columns are matched with struct fields by name,
+// columns without field are skipped
+func (c *Cursor) scanRow(dest reflect.Value) error {
+	values := make([]interface{}, len(c.columnTypes))
+	ptrs := make([]interface{}, len(values))
+	for idx := range values {
+		ptrs[idx] = &values[idx]
+	}
+	if err := c.rows.Scan(ptrs...); err != nil {
+		return err
+	}
+	for idx, value := range values {
+		values[idx] = rawValue(value)
+	}
+
+	switch dest.Kind() {
+	case reflect.Map:
+		if dest.IsNil() {
+			dest.Set(reflect.MakeMap(dest.Type()))
+		}
+		for idx, ct := range c.columnTypes {
+			v, err := c.castValue(values[idx], "", ct)
+			if err != nil {
+				return fmt.Errorf("unable to read %s. %s", ct.Name(), err.Error())
+			}
+			mv := reflect.Zero(dest.Type().Elem())
+			if v != nil {
+				mv = reflect.ValueOf(v)
+			}
+			if !mv.Type().AssignableTo(dest.Type().Elem()) {
+				return fmt.Errorf("unable to read %s. %s is not assignable into %s", ct.Name(), mv.Type().String(), dest.Type().Elem().String())
+			}
+			dest.SetMapIndex(reflect.ValueOf(ct.Name()), mv)
+		}
+
+	case reflect.Struct:
+		fields := structFields(dest.Type())
+		for idx, ct := range c.columnTypes {
+			index, ok := fields[strings.ToLower(ct.Name())]
+			if !ok {
+				continue
+			}
+			field := dest.FieldByIndex(index)
+			v, err := c.castField(values[idx], field.Type(), ct)
+			if err != nil {
+				return fmt.Errorf("unable to read %s. %s", ct.Name(), err.Error())
+			}
+			field.Set(v)
+		}
+
+	default:
+		return fmt.Errorf("unable to fetch into %s", dest.Type().String())
+	}
+	return nil
+}
+
+// rawValue normalizes value decoded by the driver, ie int64 of a query with ? arguments, into text
+// read by castValue. NULL and time.Time decoded with parseTime are kept
+func rawValue(value interface{}) interface{} {
+	switch value.(type) {
+	case nil, []byte, time.Time:
+		return value
+	case float32:
+		return []byte(strconv.FormatFloat(float64(value.(float32)), 'f', -1, 32))
+	case float64:
+		return []byte(strconv.FormatFloat(value.(float64), 'f', -1, 64))
+	case string:
+		return []byte(value.(string))
+	}
+	return []byte(fmt.Sprintf("%v", value))
+}
+
+// structFields maps lower case column name into index of struct field, fields of embedded struct are included
+func structFields(t reflect.Type) map[string][]int {
+	fields := map[string][]int{}
+	for idx := 0; idx < t.NumField(); idx++ {
+		ft := t.Field(idx)
+		if ft.PkgPath != "" && !ft.Anonymous {
+			continue
+		}
+		if ft.Anonymous && ft.Type.Kind() == reflect.Struct && ft.Tag.Get(codekit.TagName()) == "" {
+			for name, index := range structFields(ft.Type) {
+				if _, ok := fields[name]; !ok {
+					fields[name] = append([]int{idx}, index...)
+				}
+			}
+			continue
+		}
+		name := columnName(ft)
+		if name == "-" {
+			continue
+		}
+		fields[strings.ToLower(name)] = []int{idx}
+	}
+	return fields
+}
+
+// castField converts value of column ct into field type ft. JSON is unmarshalled into ft itself,
+// so struct, typed slice and typed map fields keep their type
+func (c *Cursor) castField(value interface{}, ft reflect.Type, ct *sql.ColumnType) (reflect.Value, error) {
+	if ft.Kind() == reflect.Interface {
+		v, err := c.castValue(value, "", ct)
+		if err != nil || v == nil {
+			return reflect.Zero(ft), err
+		}
+		return reflect.ValueOf(v), nil
+	}
+
+	if b, ok := value.([]byte); ok && isJSONField(b, ft, ct) {
+		if b == nil || string(b) == "null" {
+			return reflect.Zero(ft), nil
+		}
+		target := ft
+		for target.Kind() == reflect.Ptr {
+			target = target.Elem()
+		}
+		d, err := decodeJSON(b)
+		if err != nil {
+			return reflect.Zero(ft), err
+		}
+		rv := reflect.ValueOf(d)
+		if d != nil && rv.Type().AssignableTo(target) {
+			rv = rv.Convert(target)
+		} else {
+			rv = reflect.New(target)
+			if err = json.Unmarshal(b, rv.Interface()); err != nil {
+				return reflect.Zero(ft), err
+			}
+			rv = rv.Elem()
+		}
+		for rv.Type() != ft {
+			ptr := reflect.New(rv.Type())
+			ptr.Elem().Set(rv)
+			rv = ptr
+		}
+		return rv, nil
+	}
+
+	v, err := c.castValue(value, ft.String(), ct)
+	if err != nil || v == nil {
+		return reflect.Zero(ft), err
+	}
+	rv := reflect.ValueOf(v)
+	if rv.Type().AssignableTo(ft) {
+		return rv, nil
+	}
+	if rv.Type().ConvertibleTo(ft) {
+		return rv.Convert(ft), nil
+	}
+	return reflect.Zero(ft), fmt.Errorf("unable to cast %s into %s", rv.Type().String(), ft.String())
+}
+
+// isJSONField check if value of column ct is JSON to be unmarshalled into ft. It is JSON column, or JSON text
+// of older table, which is varchar, read into struct, map or slice
+func isJSONField(value []byte, ft reflect.Type, ct *sql.ColumnType) bool {
+	for ft.Kind() == reflect.Ptr {
+		ft = ft.Elem()
+	}
+	if !isJSONType(ft) {
+		return false
+	}
+
+	if ct != nil && ct.DatabaseTypeName() == "JSON" {
+		return true
+	}
+	return len(value) > 0 && (value[0] == '{' || value[0] == '[')
+}
+
+// CastValue converts value read from database into typeName. Column of the value is unknown here, so empty
+// typeName guesses type from the value content. Fetch and Fetchs decode values by type of their column.
+// NULL is returned as nil for codekit.M and pointer targets, and as invalid value for sql.Null* targets
 func (c *Cursor) CastValue(value interface{}, typeName string) (interface{}, error) {
+	return c.castValue(value, typeName, nil)
+}
+
+func (c *Cursor) castValue(value interface{}, typeName string, ct *sql.ColumnType) (interface{}, error) {
 	var d interface{}
 	var err error
 
+	if isDecimalType(typeName) {
+		return castDecimal(value, typeName)
+	}
+
+	if isNullValue(value) {
+		if typeName == "" || strings.HasPrefix(typeName, "*") {
+			return nil, nil
+		}
+		if strings.HasPrefix(typeName, "sql.Null") {
+			return castNullType(nil, typeName, c.loc)
+		}
+		// non nullable target gets its zero value
+	}
+
+	if strings.HasPrefix(typeName, "*") {
+		d, err = c.castValue(value, typeName[1:], ct)
+		if err != nil || d == nil {
+			return nil, err
+		}
+		ptr := reflect.New(reflect.TypeOf(d))
+		ptr.Elem().Set(reflect.ValueOf(d))
+		return ptr.Interface(), nil
+	}
+
+	if strings.HasPrefix(typeName, "sql.Null") {
+		return castNullType(value, typeName, c.loc)
+	}
+
+	if dt, ok := value.(time.Time); ok && (typeName == "" || strings.HasPrefix(typeName, "time")) {
+		return dt, nil
+	}
+
+	if typeName == "" && ct != nil && !c.guessType {
+		return decodeColumn(value, ct.DatabaseTypeName(), c.loc)
+	}
+
+	// JSON column, or JSON text of older table, into map, slice or struct target
+	if typeName != "" && typeName != "string" && !isNullValue(value) {
+		if b, ok := value.([]byte); ok {
+			isJSONColumn := ct != nil && ct.DatabaseTypeName() == "JSON"
+			isJSONTarget := strings.HasPrefix(typeName, "map[") || (strings.HasPrefix(typeName, "[]") && typeName != "[]uint8")
+			if isJSONColumn || (isJSONTarget && len(b) > 0 && (b[0] == '{' || b[0] == '[')) {
+				return decodeJSON(b)
+			}
+		}
+	}
+
 	v := ""
 	func() {
 		defer func() {
@@ -25,6 +334,10 @@ func (c *Cursor) CastValue(value interface{}, typeName string) (interface{}, err
 				v = ""
 			}
 		}()
+		if dt, ok := value.(time.Time); ok {
+			v = dt.Format(timeLayout)
+			return
+		}
 		v = string(value.([]byte))
 	}()
 
@@ -52,13 +365,18 @@ func (c *Cursor) CastValue(value interface{}, typeName string) (interface{}, err
 		} else {
 			typeName := strings.ToLower(typeName)
 			if strings.HasPrefix(typeName, "float32") {
-				d = codekit.ToFloat32(v, 4, codekit.RoundingAuto)
+				f, _ := strconv.ParseFloat(v, 32)
+				d = float32(f)
 			} else if strings.HasPrefix(typeName, "float64") {
-				d = codekit.ToFloat64(v, 4, codekit.RoundingAuto)
-			} else if strings.HasPrefix(typeName, "int") && !strings.HasPrefix(typeName, "interface") {
-				d = codekit.ToInt(v, codekit.RoundingAuto)
+				d, _ = strconv.ParseFloat(v, 64)
+			} else if bits, ok := integerBits[typeName]; ok {
+				d = castInteger(v, typeName, bits)
 			} else if strings.HasPrefix(typeName, "time") {
-				if dt, err := time.Parse(time.RFC3339, v); err == nil {
+				if dt, ok := value.(time.Time); ok {
+					d = dt
+				} else if dt, err := parseDateTime(v, c.loc); err == nil {
+					d = dt
+				} else if dt, err := time.Parse(time.RFC3339, v); err == nil {
 					d = dt
 				} else if dt = codekit.String2Date(v, "yyyy-MM-dd HH:mm:ss"); dt.Year() > 0 {
 					d = dt
@@ -73,3 +391,194 @@ func (c *Cursor) CastValue(value interface{}, typeName string) (interface{}, err
 
 	return d, err
 }
+
+// decodeColumn decodes value based on MySQL type of its column
+func decodeColumn(value interface{}, dbType string, loc *time.Location) (interface{}, error) {
+	var v string
+	switch value.(type) {
+	case nil:
+		return nil, nil
+	case []byte:
+		if strings.HasSuffix(dbType, "BLOB") || strings.HasSuffix(dbType, "BINARY") || dbType == "BIT" {
+			return append([]byte{}, value.([]byte)...), nil
+		}
+		v = string(value.([]byte))
+	case string:
+		v = value.(string)
+	default:
+		// driver has decoded the value, ie time.Time with parseTime
+		return value, nil
+	}
+
+	switch dbType {
+	case "TINYINT", "SMALLINT", "MEDIUMINT", "INT", "YEAR":
+		return strconv.Atoi(v)
+
+	case "BIGINT":
+		if i, err := strconv.ParseInt(v, 10, 64); err == nil {
+			return i, nil
+		}
+		return strconv.ParseUint(v, 10, 64)
+
+	case "DECIMAL":
+		// kept exact, float64 would round it
+		return Decimal(v), nil
+
+	case "FLOAT", "DOUBLE":
+		return strconv.ParseFloat(v, 64)
+
+	case "DATETIME", "TIMESTAMP", "DATE":
+		return parseDateTime(v, loc)
+
+	case "JSON":
+		return decodeJSON([]byte(v))
+	}
+	return v, nil
+}
+
+// decodeJSON unmarshals JSON document, objects are returned as codekit.M and arrays as []interface{}
+func decodeJSON(b []byte) (interface{}, error) {
+	var v interface{}
+	if err := json.Unmarshal(b, &v); err != nil {
+		return nil, err
+	}
+	return jsonToM(v), nil
+}
+
+func jsonToM(v interface{}) interface{} {
+	switch v.(type) {
+	case map[string]interface{}:
+		m := codekit.M{}
+		for key, item := range v.(map[string]interface{}) {
+			m[key] = jsonToM(item)
+		}
+		return m
+	case []interface{}:
+		items := v.([]interface{})
+		for idx, item := range items {
+			items[idx] = jsonToM(item)
+		}
+		return items
+	}
+	return v
+}
+
+// parseDateTime parses MySQL date and datetime text including its fractional second in loc
+func parseDateTime(v string, loc *time.Location) (time.Time, error) {
+	if strings.HasPrefix(v, "0000-00-00") {
+		return time.Time{}, nil
+	}
+	if loc == nil {
+		loc = time.Local
+	}
+	layout := timeLayout
+	if len(v) == 10 {
+		layout = "2006-01-02"
+	}
+	return time.ParseInLocation(layout, v, loc)
+}
+
+// isNullValue check if value read from database is NULL
+func isNullValue(value interface{}) bool {
+	if value == nil {
+		return true
+	}
+	if b, ok := value.([]byte); ok {
+		return b == nil
+	}
+	return false
+}
+
+// castNullType converts value into sql.Null* type named typeName, nil value gives invalid one
+func castNullType(value interface{}, typeName string, loc *time.Location) (interface{}, error) {
+	if b, ok := value.([]byte); ok {
+		value = string(b)
+	}
+
+	switch typeName {
+	case "sql.NullString":
+		n := sql.NullString{}
+		err := n.Scan(value)
+		return n, err
+
+	case "sql.NullInt64":
+		n := sql.NullInt64{}
+		err := n.Scan(value)
+		return n, err
+
+	case "sql.NullInt32":
+		n := sql.NullInt32{}
+		err := n.Scan(value)
+		return n, err
+
+	case "sql.NullFloat64":
+		n := sql.NullFloat64{}
+		err := n.Scan(value)
+		return n, err
+
+	case "sql.NullBool":
+		n := sql.NullBool{}
+		err := n.Scan(value)
+		return n, err
+
+	case "sql.NullTime":
+		n := sql.NullTime{}
+		switch value.(type) {
+		case nil:
+		case string:
+			dt, err := parseDateTime(value.(string), loc)
+			if err != nil {
+				return n, err
+			}
+			n.Time, n.Valid = dt, true
+		default:
+			err := n.Scan(value)
+			return n, err
+		}
+		return n, nil
+	}
+	return nil, fmt.Errorf("unsupported type %s", typeName)
+}
+
+// integerBits is size of Go integer types, 0 means size of int
+var integerBits = map[string]int{
+	"int": 0, "int8": 8, "int16": 16, "int32": 32, "int64": 64,
+	"uint": 0, "uint8": 8, "uint16": 16, "uint32": 32, "uint64": 64,
+}
+
+// castInteger parses v into integer type named typeName without losing its width and sign
+func castInteger(v string, typeName string, bits int) interface{} {
+	if strings.HasPrefix(typeName, "u") {
+		u, err := strconv.ParseUint(v, 10, bits)
+		if err != nil {
+			u = uint64(codekit.ToInt(v, codekit.RoundingAuto))
+		}
+		switch typeName {
+		case "uint8":
+			return uint8(u)
+		case "uint16":
+			return uint16(u)
+		case "uint32":
+			return uint32(u)
+		case "uint64":
+			return u
+		}
+		return uint(u)
+	}
+
+	i, err := strconv.ParseInt(v, 10, bits)
+	if err != nil {
+		i = int64(codekit.ToInt(v, codekit.RoundingAuto))
+	}
+	switch typeName {
+	case "int8":
+		return int8(i)
+	case "int16":
+		return int16(i)
+	case "int32":
+		return int32(i)
+	case "int64":
+		return i
+	}
+	return int(i)
+}
@@ -1,12 +1,17 @@
 package flexmy_test
 
 import (
+	"context"
+	"database/sql"
 	"errors"
 	"fmt"
+	"math/big"
 	"testing"
 	"time"
 
 	"git.kanosolution.net/kano/dbflex"
+	"github.com/ariefdarmawan/flexmy"
+	"github.com/go-sql-driver/mysql"
 	"github.com/sebarcode/codekit"
 	cv "github.com/smartystreets/goconvey/convey"
 )
@@ -121,6 +126,41 @@ func TestQueryObj(t *testing.T) {
 	})
 }
 
+type partialObject struct {
+	ID      string
+	Created time.Time
+}
+
+func TestQueryPartialObj(t *testing.T) {
+	conn, _ := connect()
+	defer conn.Close()
+	partialTable := "testpartial"
+
+	cv.Convey("fetch into struct with fewer fields than columns", t, func() {
+		conn.DropTable(partialTable)
+		cv.So(conn.EnsureTable(partialTable, []string{"ID"}, new(dataObject)), cv.ShouldBeNil)
+		created := time.Date(2021, 3, 4, 5, 6, 7, 0, time.Local)
+		for _, id := range []string{"P1", "P2", "P3"} {
+			data := &dataObject{ID: id, Title: "Title " + id, DataDec: 1.5, DataGroup: "G1", Created: created}
+			_, err := conn.Execute(dbflex.From(partialTable).Insert(), codekit.M{}.Set("data", data))
+			cv.So(err, cv.ShouldBeNil)
+		}
+
+		cur := conn.Cursor(dbflex.From(partialTable).Select(), nil)
+		defer cur.Close()
+		objs := []partialObject{}
+		cv.So(cur.Fetchs(&objs, 0), cv.ShouldBeNil)
+		cv.So(len(objs), cv.ShouldEqual, 3)
+		ids := []string{}
+		for _, obj := range objs {
+			ids = append(ids, obj.ID)
+			cv.So(obj.Created.Equal(created), cv.ShouldBeTrue)
+		}
+		cv.So(ids, cv.ShouldContain, "P1")
+		cv.So(ids, cv.ShouldContain, "P3")
+	})
+}
+
 func TestQueryDelete(t *testing.T) {
 	cv.Convey("connecting", t, func() {
 		conn, err := connect()
@@ -128,18 +168,38 @@ func TestQueryDelete(t *testing.T) {
 		defer conn.Close()
 
 		cv.Convey("insert data 100x ", func() {
+			dos := []*dataObject{}
 			for i := 0; i < 100; i++ {
-				cmd := dbflex.From(tableName).Insert()
-				_, err := conn.Execute(cmd, codekit.M{}.Set("data", newDataObject(codekit.RandomString(10), "QD")))
-				if err != nil {
-					cv.Println("error saving.", err.Error())
-				}
+				dos = append(dos, newDataObject(codekit.RandomString(10), "QD"))
 			}
+			cmd := dbflex.From(tableName).Insert()
+			r, err := conn.Execute(cmd, codekit.M{}.Set("data", dos))
+			cv.So(err, cv.ShouldBeNil)
+			affected, _ := r.(sql.Result).RowsAffected()
+			cv.So(affected, cv.ShouldEqual, 100)
+
 			cursor := conn.Cursor(dbflex.From(tableName).Where(dbflex.Eq("datagroup", "QD")).Select(), nil)
 			cv.So(cursor.Error(), cv.ShouldEqual, nil)
 			count := cursor.Count()
 			cv.So(count, cv.ShouldBeGreaterThan, 99)
 
+			cv.Convey("insert M rows with different fields", func() {
+				conn.Execute(dbflex.From(tableName).Delete().Where(dbflex.Eq("datagroup", "QDM")), nil)
+				ms := []codekit.M{
+					codekit.M{}.Set("ID", "qdm_1").Set("DataGroup", "QDM"),
+					codekit.M{}.Set("ID", "qdm_2").Set("DataGroup", "QDM").Set("Title", "Second"),
+				}
+				_, err := conn.Execute(dbflex.From(tableName).Insert(), codekit.M{}.Set("data", ms))
+				cv.So(err, cv.ShouldBeNil)
+
+				cur := conn.Cursor(dbflex.From(tableName).Select().Where(dbflex.Eq("id", "qdm_2")), nil)
+				defer cur.Close()
+				objs := []dataObject{}
+				cv.So(cur.Fetchs(&objs, 0), cv.ShouldBeNil)
+				cv.So(len(objs), cv.ShouldEqual, 1)
+				cv.So(objs[0].Title, cv.ShouldEqual, "Second")
+			})
+
 			cv.Convey("delete fews data", func() {
 				dos := make([]dataObject, 5)
 				cursor.Fetchs(&dos, 5)
@@ -237,3 +297,1099 @@ func TestTrx(t *testing.T) {
 		})
 	})
 }
+
+func TestQueryQuotedValue(t *testing.T) {
+	cv.Convey("connecting", t, func() {
+		conn, err := connect()
+		cv.So(err, cv.ShouldBeNil)
+		defer conn.Close()
+
+		cv.Convey("insert data with quote", func() {
+			conn.Execute(dbflex.From(tableName).Delete().Where(dbflex.Eq("id", "QQ1")), nil)
+			data := newDataObject("QQ1", "QQ")
+			data.Title = "Arief's title \\ ' or 1=1 --"
+			_, err := conn.Execute(dbflex.From(tableName).Insert(), codekit.M{}.Set("data", data))
+			cv.So(err, cv.ShouldBeNil)
+
+			cv.Convey("filter with quote", func() {
+				cur := conn.Cursor(dbflex.From(tableName).Select().Where(dbflex.Eq("title", data.Title)), nil)
+				defer cur.Close()
+				cv.So(cur.Error(), cv.ShouldBeNil)
+
+				ms := []dataObject{}
+				err := cur.Fetchs(&ms, 0)
+				cv.So(err, cv.ShouldBeNil)
+				cv.So(len(ms), cv.ShouldEqual, 1)
+				cv.So(ms[0].Title, cv.ShouldEqual, data.Title)
+			})
+		})
+	})
+}
+
+func TestQueryContext(t *testing.T) {
+	cv.Convey("connecting", t, func() {
+		conn, err := connect()
+		cv.So(err, cv.ShouldBeNil)
+		defer conn.Close()
+		myconn := conn.(*flexmy.Connection)
+
+		cv.Convey("querying with live context", func() {
+			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+			defer cancel()
+			cur := myconn.CursorContext(ctx, dbflex.From(tableName).Select(), nil)
+			cv.So(cur.Error(), cv.ShouldBeNil)
+			ms := []codekit.M{}
+			cv.So(cur.Fetchs(&ms, 0), cv.ShouldBeNil)
+			cur.Close()
+
+			cv.Convey("querying with cancelled context", func() {
+				ctx, cancel := context.WithCancel(context.Background())
+				cancel()
+				cur := myconn.CursorContext(ctx, dbflex.From(tableName).Select(), nil)
+				defer cur.Close()
+				cv.So(cur.Error(), cv.ShouldNotBeNil)
+
+				_, err := myconn.ExecuteContext(ctx, dbflex.From(tableName).Delete().Where(dbflex.Eq("id", "none")), nil)
+				cv.So(err, cv.ShouldNotBeNil)
+			})
+		})
+	})
+}
+
+func TestSave(t *testing.T) {
+	cv.Convey("connecting", t, func() {
+		conn, err := connect()
+		cv.So(err, cv.ShouldBeNil)
+		defer conn.Close()
+
+		cv.Convey("saving same data twice", func() {
+			data := newDataObject("SV1", "SV")
+			cmd := dbflex.From(tableName).Where(dbflex.Eq("id", data.ID)).Save()
+			_, err := conn.Execute(cmd, codekit.M{}.Set("data", data))
+			cv.So(err, cv.ShouldBeNil)
+
+			data.Title = "Saved twice"
+			_, err = conn.Execute(cmd, codekit.M{}.Set("data", data))
+			cv.So(err, cv.ShouldBeNil)
+
+			cv.Convey("validate", func() {
+				cur := conn.Cursor(dbflex.From(tableName).Select().Where(dbflex.Eq("id", data.ID)), nil)
+				defer cur.Close()
+				ms := []dataObject{}
+				cv.So(cur.Fetchs(&ms, 0), cv.ShouldBeNil)
+				cv.So(len(ms), cv.ShouldEqual, 1)
+				cv.So(ms[0].Title, cv.ShouldEqual, "Saved twice")
+			})
+		})
+	})
+}
+
+func TestImportChan(t *testing.T) {
+	cv.Convey("connecting", t, func() {
+		conn, err := connect()
+		cv.So(err, cv.ShouldBeNil)
+		defer conn.Close()
+		conn.Execute(dbflex.From(tableName).Delete().Where(dbflex.Eq("datagroup", "IM")), nil)
+
+		cv.Convey("import 1000 data", func() {
+			ch := make(chan *dataObject)
+			go func() {
+				for i := 0; i < 1000; i++ {
+					ch <- newDataObject(fmt.Sprintf("im_%d", i), "IM")
+				}
+				close(ch)
+			}()
+
+			res, err := conn.(*flexmy.Connection).ImportChan(context.Background(), tableName, ch, nil)
+			cv.So(err, cv.ShouldBeNil)
+			cv.So(res.RowsLoaded, cv.ShouldEqual, 1000)
+			cv.So(len(res.Warnings), cv.ShouldEqual, 0)
+		})
+
+		cv.Convey("import reordered subset of fields", func() {
+			conn.Execute(dbflex.From(tableName).Delete().Where(dbflex.Eq("datagroup", "IF")), nil)
+			ch := make(chan *dataObject, 1)
+			ch <- &dataObject{ID: "if_1", Title: "Subset", DataGroup: "IF"}
+			close(ch)
+
+			res, err := conn.(*flexmy.Connection).ImportChan(context.Background(), tableName, ch,
+				&flexmy.ImportOptions{Fields: []string{"DataGroup", "Title", "ID"}})
+			cv.So(err, cv.ShouldBeNil)
+			cv.So(res.RowsLoaded, cv.ShouldEqual, 1)
+
+			cur := conn.Cursor(dbflex.From(tableName).Select().Where(dbflex.Eq("datagroup", "IF")), nil)
+			defer cur.Close()
+			objs := []dataObject{}
+			cv.So(cur.Fetchs(&objs, 0), cv.ShouldBeNil)
+			cv.So(len(objs), cv.ShouldEqual, 1)
+			cv.So(objs[0].ID, cv.ShouldEqual, "if_1")
+			cv.So(objs[0].Title, cv.ShouldEqual, "Subset")
+
+			cv.Convey("failed import does not block producer", func() {
+				ch := make(chan *dataObject)
+				done := make(chan bool)
+				go func() {
+					for i := 0; i < 10000; i++ {
+						ch <- newDataObject(fmt.Sprintf("ie_%d", i), "IE")
+					}
+					close(ch)
+					done <- true
+				}()
+
+				_, err := conn.(*flexmy.Connection).ImportChan(context.Background(), "nosuchtable", ch, nil)
+				cv.So(err, cv.ShouldNotBeNil)
+				select {
+				case <-done:
+				case <-time.After(10 * time.Second):
+					t.Fatal("producer is blocked")
+				}
+			})
+
+			cv.Convey("unknown field is refused", func() {
+				_, err := conn.(*flexmy.Connection).ImportChan(context.Background(), tableName, make(chan *dataObject),
+					&flexmy.ImportOptions{Fields: []string{"ID", "NoSuchField"}})
+				cv.So(err, cv.ShouldNotBeNil)
+			})
+		})
+	})
+}
+
+func TestNestedTrx(t *testing.T) {
+	conn, _ := connect()
+	defer conn.Close()
+	groupcode := "NT"
+
+	conn.Execute(dbflex.From(tableName).Delete().Where(dbflex.Eq("datagroup", groupcode)), nil)
+	cv.Convey("outer transaction", t, func() {
+		cv.So(conn.BeginTx(), cv.ShouldBeNil)
+		_, err := conn.Execute(dbflex.From(tableName).Insert(), codekit.M{}.Set("data", newDataObject("nt_outer", groupcode)))
+		cv.So(err, cv.ShouldBeNil)
+
+		cv.Convey("inner transaction rolled back", func() {
+			cv.So(conn.BeginTx(), cv.ShouldBeNil)
+			cv.So(conn.(*flexmy.Connection).TxLevel(), cv.ShouldEqual, 2)
+			_, err := conn.Execute(dbflex.From(tableName).Insert(), codekit.M{}.Set("data", newDataObject("nt_inner", groupcode)))
+			cv.So(err, cv.ShouldBeNil)
+			cv.So(conn.RollBack(), cv.ShouldBeNil)
+
+			cv.Convey("commit outer and validate", func() {
+				cv.So(conn.Commit(), cv.ShouldBeNil)
+				cv.So(conn.(*flexmy.Connection).IsTx(), cv.ShouldBeFalse)
+
+				cur := conn.Cursor(dbflex.From(tableName).Select().Where(dbflex.Eq("datagroup", groupcode)), nil)
+				defer cur.Close()
+				ms := []dataObject{}
+				cv.So(cur.Fetchs(&ms, 0), cv.ShouldBeNil)
+				cv.So(len(ms), cv.ShouldEqual, 1)
+				cv.So(ms[0].ID, cv.ShouldEqual, "nt_outer")
+			})
+		})
+	})
+}
+
+func TestTrxOptions(t *testing.T) {
+	conn, _ := connect()
+	defer conn.Close()
+	myconn := conn.(*flexmy.Connection)
+
+	cv.Convey("read only consistent snapshot", t, func() {
+		err := myconn.BeginTxWithOptions(context.Background(), &flexmy.TxOptions{
+			Isolation:          sql.LevelRepeatableRead,
+			ReadOnly:           true,
+			ConsistentSnapshot: true,
+		})
+		cv.So(err, cv.ShouldBeNil)
+		defer myconn.RollBack()
+
+		level, err := myconn.IsolationLevel()
+		cv.So(err, cv.ShouldBeNil)
+		cv.So(level, cv.ShouldEqual, sql.LevelRepeatableRead)
+
+		_, err = conn.Execute(dbflex.From(tableName).Insert(), codekit.M{}.Set("data", newDataObject("ro_1", "RO")))
+		cv.So(err, cv.ShouldNotBeNil)
+	})
+
+	cv.Convey("snapshot isolation does not leak into session", t, func() {
+		cv.So(myconn.BeginTxWithOptions(context.Background(), nil), cv.ShouldBeNil)
+		sessionLevel, err := myconn.IsolationLevel()
+		cv.So(err, cv.ShouldBeNil)
+		cv.So(myconn.RollBack(), cv.ShouldBeNil)
+
+		err = myconn.BeginTxWithOptions(context.Background(), &flexmy.TxOptions{
+			Isolation:          sql.LevelSerializable,
+			ConsistentSnapshot: true,
+		})
+		cv.So(err, cv.ShouldBeNil)
+		cv.So(myconn.RollBack(), cv.ShouldBeNil)
+
+		cv.So(myconn.BeginTxWithOptions(context.Background(), nil), cv.ShouldBeNil)
+		defer myconn.RollBack()
+		level, err := myconn.IsolationLevel()
+		cv.So(err, cv.ShouldBeNil)
+		cv.So(level, cv.ShouldEqual, sessionLevel)
+	})
+}
+
+func TestRunInTx(t *testing.T) {
+	conn, _ := connect()
+	defer conn.Close()
+	myconn := conn.(*flexmy.Connection)
+	groupcode := "RT"
+
+	conn.Execute(dbflex.From(tableName).Delete().Where(dbflex.Eq("datagroup", groupcode)), nil)
+	cv.Convey("run in transaction", t, func() {
+		err := myconn.RunInTx(func(c dbflex.IConnection) error {
+			_, err := c.Execute(dbflex.From(tableName).Insert(), codekit.M{}.Set("data", newDataObject("rt_1", groupcode)))
+			return err
+		}, nil)
+		cv.So(err, cv.ShouldBeNil)
+
+		cv.Convey("failed closure is rolled back", func() {
+			err := myconn.RunInTx(func(c dbflex.IConnection) error {
+				c.Execute(dbflex.From(tableName).Insert(), codekit.M{}.Set("data", newDataObject("rt_2", groupcode)))
+				return errors.New("closure failed")
+			}, &flexmy.RunInTxOptions{MaxRetry: 1})
+			cv.So(err, cv.ShouldNotBeNil)
+
+			cur := conn.Cursor(dbflex.From(tableName).Select().Where(dbflex.Eq("datagroup", groupcode)), nil)
+			defer cur.Close()
+			cv.So(cur.Count(), cv.ShouldEqual, 1)
+		})
+
+		cv.Convey("deadlock is retried unless retry is turned off", func() {
+			attempts := 0
+			deadlock := func(c dbflex.IConnection) error {
+				attempts++
+				return &flexmy.Error{Kind: flexmy.ErrDeadlock, Err: errors.New("deadlock found")}
+			}
+
+			err := myconn.RunInTx(deadlock, &flexmy.RunInTxOptions{MaxRetry: 2, BackoffBase: time.Millisecond})
+			cv.So(errors.Is(err, flexmy.ErrDeadlock), cv.ShouldBeTrue)
+			cv.So(attempts, cv.ShouldEqual, 3)
+
+			attempts = 0
+			err = myconn.RunInTx(deadlock, &flexmy.RunInTxOptions{MaxRetry: flexmy.NoRetry})
+			cv.So(errors.Is(err, flexmy.ErrDeadlock), cv.ShouldBeTrue)
+			cv.So(attempts, cv.ShouldEqual, 1)
+
+			attempts = 0
+			err = myconn.RunInTx(func(c dbflex.IConnection) error {
+				attempts++
+				return &mysql.MySQLError{Number: 1213, Message: "Deadlock found"}
+			}, &flexmy.RunInTxOptions{MaxRetry: 1, BackoffBase: time.Millisecond})
+			cv.So(err, cv.ShouldNotBeNil)
+			cv.So(attempts, cv.ShouldEqual, 2)
+		})
+	})
+}
+
+func TestErrorKind(t *testing.T) {
+	conn, _ := connect()
+	defer conn.Close()
+
+	cv.Convey("duplicate key", t, func() {
+		data := newDataObject("EK1", "EK")
+		conn.Execute(dbflex.From(tableName).Where(dbflex.Eq("id", data.ID)).Save(), codekit.M{}.Set("data", data))
+		_, err := conn.Execute(dbflex.From(tableName).Insert(), codekit.M{}.Set("data", data))
+		cv.So(errors.Is(err, flexmy.ErrDuplicateKey), cv.ShouldBeTrue)
+
+		var sqlErr *flexmy.Error
+		cv.So(errors.As(err, &sqlErr), cv.ShouldBeTrue)
+		cv.So(sqlErr.SQL, cv.ShouldContainSubstring, tableName)
+
+		cv.Convey("missing table", func() {
+			cur := conn.Cursor(dbflex.From("nosuchtable").Select(), nil)
+			defer cur.Close()
+			cv.So(errors.Is(cur.Error(), flexmy.ErrNoTable), cv.ShouldBeTrue)
+		})
+
+		cv.Convey("save into missing table", func() {
+			_, err := conn.Execute(dbflex.From("nosuchtable").Where(dbflex.Eq("ID", data.ID)).Save(), codekit.M{}.Set("data", data))
+			cv.So(errors.Is(err, flexmy.ErrNoTable), cv.ShouldBeTrue)
+		})
+	})
+}
+
+func TestLock(t *testing.T) {
+	conn, _ := connect()
+	defer conn.Close()
+
+	cv.Convey("lock outside transaction", t, func() {
+		cur := conn.Cursor(dbflex.From(tableName).Select(), codekit.M{}.Set(flexmy.ConfigLock, flexmy.LockForUpdateSkipLocked))
+		defer cur.Close()
+		cv.So(cur.Error(), cv.ShouldNotBeNil)
+
+		cv.Convey("lock inside transaction", func() {
+			cv.So(conn.BeginTx(), cv.ShouldBeNil)
+			defer conn.RollBack()
+
+			cur := conn.Cursor(dbflex.From(tableName).Select().Where(dbflex.Eq("datagroup", "QD")),
+				codekit.M{}.Set(flexmy.ConfigLock, flexmy.LockForUpdateSkipLocked))
+			defer cur.Close()
+			cv.So(cur.Error(), cv.ShouldBeNil)
+			ms := []dataObject{}
+			cv.So(cur.Fetchs(&ms, 1), cv.ShouldBeNil)
+		})
+	})
+}
+
+func TestColumnTypeDecoding(t *testing.T) {
+	conn, _ := connect()
+	defer conn.Close()
+
+	cv.Convey("numeric looking varchar", t, func() {
+		data := newDataObject("CT1", "CT")
+		data.Title = "00123"
+		_, err := conn.Execute(dbflex.From(tableName).Where(dbflex.Eq("id", data.ID)).Save(), codekit.M{}.Set("data", data))
+		cv.So(err, cv.ShouldBeNil)
+
+		cv.Convey("fetch into M", func() {
+			cur := conn.Cursor(dbflex.From(tableName).Select().Where(dbflex.Eq("id", data.ID)), nil)
+			defer cur.Close()
+			ms := []codekit.M{}
+			cv.So(cur.Fetchs(&ms, 0), cv.ShouldBeNil)
+			cv.So(len(ms), cv.ShouldEqual, 1)
+			cv.So(ms[0]["Title"], cv.ShouldEqual, "00123")
+			cv.So(ms[0]["DataDec"], cv.ShouldHaveSameTypeAs, float64(0))
+			cv.So(ms[0]["Created"], cv.ShouldHaveSameTypeAs, time.Time{})
+		})
+	})
+}
+
+type nullObject struct {
+	ID   string
+	Note *string
+	Memo sql.NullString
+}
+
+func TestNull(t *testing.T) {
+	conn, _ := connect()
+	defer conn.Close()
+	nullTable := "testnull"
+
+	cv.Convey("write nulls", t, func() {
+		conn.DropTable(nullTable)
+		cv.So(conn.EnsureTable(nullTable, []string{"ID"}, new(nullObject)), cv.ShouldBeNil)
+		_, err := conn.Execute(dbflex.From(nullTable).Insert(), codekit.M{}.Set("data", &nullObject{ID: "N1"}))
+		cv.So(err, cv.ShouldBeNil)
+
+		cv.Convey("filter and read nulls into M", func() {
+			cur := conn.Cursor(dbflex.From(nullTable).Select().Where(dbflex.Eq("Note", nil)), nil)
+			defer cur.Close()
+			ms := []codekit.M{}
+			cv.So(cur.Fetchs(&ms, 0), cv.ShouldBeNil)
+			cv.So(len(ms), cv.ShouldEqual, 1)
+			cv.So(ms[0]["Note"], cv.ShouldBeNil)
+			cv.So(ms[0]["Memo"], cv.ShouldBeNil)
+
+			cv.Convey("read nulls into struct", func() {
+				cur := conn.Cursor(dbflex.From(nullTable).Select(), nil)
+				defer cur.Close()
+				objs := []nullObject{}
+				cv.So(cur.Fetchs(&objs, 0), cv.ShouldBeNil)
+				cv.So(len(objs), cv.ShouldEqual, 1)
+				cv.So(objs[0].Note, cv.ShouldBeNil)
+				cv.So(objs[0].Memo.Valid, cv.ShouldBeFalse)
+			})
+		})
+	})
+}
+
+type intObject struct {
+	ID    string
+	Small int8
+	Big   int64
+	Snow  uint64
+}
+
+func TestIntegerWidth(t *testing.T) {
+	conn, _ := connect()
+	defer conn.Close()
+	intTable := "testint"
+
+	cv.Convey("store wide integers", t, func() {
+		conn.DropTable(intTable)
+		cv.So(conn.EnsureTable(intTable, []string{"ID"}, new(intObject)), cv.ShouldBeNil)
+		data := &intObject{ID: "I1", Small: -128, Big: 1 << 40, Snow: 1<<64 - 1}
+		_, err := conn.Execute(dbflex.From(intTable).Insert(), codekit.M{}.Set("data", data))
+		cv.So(err, cv.ShouldBeNil)
+
+		cv.Convey("read them back", func() {
+			cur := conn.Cursor(dbflex.From(intTable).Select(), nil)
+			defer cur.Close()
+			objs := []intObject{}
+			cv.So(cur.Fetchs(&objs, 0), cv.ShouldBeNil)
+			cv.So(len(objs), cv.ShouldEqual, 1)
+			cv.So(objs[0], cv.ShouldResemble, *data)
+		})
+	})
+}
+
+type timeObject struct {
+	ID      string
+	Created time.Time
+}
+
+type nullTimeObject struct {
+	ID      string
+	Created time.Time
+	Closed  sql.NullTime
+}
+
+func TestParseTime(t *testing.T) {
+	conn, err := dbflex.NewConnectionFromURI(connString+"?parseTime=true", nil)
+	if err != nil {
+		t.Fatalf("unable to connect. %s", err.Error())
+	}
+	conn.Connect()
+	defer conn.Close()
+	parseTable := "testparsetime"
+
+	cv.Convey("read time decoded by the driver", t, func() {
+		conn.DropTable(parseTable)
+		cv.So(conn.EnsureTable(parseTable, []string{"ID"}, new(nullTimeObject)), cv.ShouldBeNil)
+
+		created := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+		data := &nullTimeObject{ID: "P1", Created: created, Closed: sql.NullTime{Time: created, Valid: true}}
+		_, err := conn.Execute(dbflex.From(parseTable).Insert(), codekit.M{}.Set("data", data))
+		cv.So(err, cv.ShouldBeNil)
+
+		cv.Convey("into M", func() {
+			cur := conn.Cursor(dbflex.From(parseTable).Select(), nil)
+			defer cur.Close()
+			ms := []codekit.M{}
+			cv.So(cur.Fetchs(&ms, 0), cv.ShouldBeNil)
+			cv.So(len(ms), cv.ShouldEqual, 1)
+			cv.So(ms[0]["Created"].(time.Time).Equal(created), cv.ShouldBeTrue)
+		})
+
+		cv.Convey("into sql.NullTime", func() {
+			cur := conn.Cursor(dbflex.From(parseTable).Select(), nil)
+			defer cur.Close()
+			objs := []nullTimeObject{}
+			cv.So(cur.Fetchs(&objs, 0), cv.ShouldBeNil)
+			cv.So(len(objs), cv.ShouldEqual, 1)
+			cv.So(objs[0].Closed.Valid, cv.ShouldBeTrue)
+			cv.So(objs[0].Closed.Time.Equal(created), cv.ShouldBeTrue)
+		})
+	})
+}
+
+func TestTimePrecision(t *testing.T) {
+	conn, err := dbflex.NewConnectionFromURI(connString+"?time_precision=6&store_loc=UTC", nil)
+	if err != nil {
+		t.Fatalf("unable to connect. %s", err.Error())
+	}
+	conn.Connect()
+	defer conn.Close()
+	timeTable := "testtime"
+
+	cv.Convey("store time with microsecond", t, func() {
+		conn.DropTable(timeTable)
+		cv.So(conn.EnsureTable(timeTable, []string{"ID"}, new(timeObject)), cv.ShouldBeNil)
+
+		jakarta := time.FixedZone("WIB", 7*3600)
+		data := &timeObject{ID: "T1", Created: time.Date(2020, 1, 2, 3, 4, 5, 123456000, jakarta)}
+		_, err := conn.Execute(dbflex.From(timeTable).Insert(), codekit.M{}.Set("data", data))
+		cv.So(err, cv.ShouldBeNil)
+
+		cv.Convey("read the same instant", func() {
+			cur := conn.Cursor(dbflex.From(timeTable).Select(), nil)
+			defer cur.Close()
+			objs := []timeObject{}
+			cv.So(cur.Fetchs(&objs, 0), cv.ShouldBeNil)
+			cv.So(len(objs), cv.ShouldEqual, 1)
+			cv.So(objs[0].Created.Equal(data.Created), cv.ShouldBeTrue)
+		})
+	})
+
+	cv.Convey("truncate fractional second at default precision", t, func() {
+		conn0, err := dbflex.NewConnectionFromURI(connString+"?store_loc=UTC", nil)
+		cv.So(err, cv.ShouldBeNil)
+		conn0.Connect()
+		defer conn0.Close()
+
+		conn0.DropTable(timeTable)
+		cv.So(conn0.EnsureTable(timeTable, []string{"ID"}, new(timeObject)), cv.ShouldBeNil)
+
+		created := time.Date(2020, 1, 2, 23, 59, 59, 600000000, time.UTC)
+		_, err = conn0.Execute(dbflex.From(timeTable).Insert(), codekit.M{}.Set("data", &timeObject{ID: "T1", Created: created}))
+		cv.So(err, cv.ShouldBeNil)
+
+		cur := conn0.Cursor(dbflex.From(timeTable).Select(), nil)
+		defer cur.Close()
+		objs := []timeObject{}
+		cv.So(cur.Fetchs(&objs, 0), cv.ShouldBeNil)
+		cv.So(len(objs), cv.ShouldEqual, 1)
+		cv.So(objs[0].Created.Equal(created.Truncate(time.Second)), cv.ShouldBeTrue)
+	})
+}
+
+type jsonAddress struct {
+	City string
+	Zip  string
+}
+
+type jsonObject struct {
+	ID      string
+	Tags    []string
+	Attrs   codekit.M
+	Address jsonAddress
+	Scores  map[string]int
+	Home    *jsonAddress
+	Visits  []jsonAddress
+}
+
+func TestJSONColumn(t *testing.T) {
+	conn, _ := connect()
+	defer conn.Close()
+	jsonTable := "testjson"
+
+	cv.Convey("store json fields", t, func() {
+		conn.DropTable(jsonTable)
+		cv.So(conn.EnsureTable(jsonTable, []string{"ID"}, new(jsonObject)), cv.ShouldBeNil)
+		data := &jsonObject{
+			ID:      "J1",
+			Tags:    []string{"a", "b"},
+			Attrs:   codekit.M{}.Set("color", "red").Set("size", 10),
+			Address: jsonAddress{"Jakarta", "00123"},
+			Scores:  map[string]int{"math": 90},
+			Home:    &jsonAddress{"Bandung", "00456"},
+			Visits:  []jsonAddress{{"Surabaya", "00789"}},
+		}
+		_, err := conn.Execute(dbflex.From(jsonTable).Insert(), codekit.M{}.Set("data", data))
+		cv.So(err, cv.ShouldBeNil)
+
+		cv.Convey("read into struct", func() {
+			cur := conn.Cursor(dbflex.From(jsonTable).Select(), nil)
+			defer cur.Close()
+			objs := []jsonObject{}
+			cv.So(cur.Fetchs(&objs, 0), cv.ShouldBeNil)
+			cv.So(len(objs), cv.ShouldEqual, 1)
+			cv.So(objs[0].Tags, cv.ShouldResemble, data.Tags)
+			cv.So(objs[0].Attrs["color"], cv.ShouldEqual, "red")
+			cv.So(objs[0].Address, cv.ShouldResemble, data.Address)
+		})
+
+		cv.Convey("read into typed fields", func() {
+			cur := conn.Cursor(dbflex.From(jsonTable).Select(), nil)
+			defer cur.Close()
+			objs := []*jsonObject{}
+			cv.So(cur.Fetchs(&objs, 0), cv.ShouldBeNil)
+			cv.So(len(objs), cv.ShouldEqual, 1)
+			cv.So(objs[0].Scores, cv.ShouldResemble, data.Scores)
+			cv.So(objs[0].Home, cv.ShouldResemble, data.Home)
+			cv.So(objs[0].Visits, cv.ShouldResemble, data.Visits)
+
+			cv.Convey("fetch a row", func() {
+				cur := conn.Cursor(dbflex.From(jsonTable).Select(), nil)
+				defer cur.Close()
+				obj := new(jsonObject)
+				cv.So(cur.Fetch(obj).Error(), cv.ShouldBeNil)
+				cv.So(obj.Home, cv.ShouldResemble, data.Home)
+			})
+		})
+
+		cv.Convey("read into M", func() {
+			cur := conn.Cursor(dbflex.From(jsonTable).Select(), nil)
+			defer cur.Close()
+			ms := []codekit.M{}
+			cv.So(cur.Fetchs(&ms, 0), cv.ShouldBeNil)
+			cv.So(len(ms), cv.ShouldEqual, 1)
+			cv.So(ms[0]["Tags"], cv.ShouldResemble, []interface{}{"a", "b"})
+			cv.So(ms[0]["Address"].(codekit.M)["Zip"], cv.ShouldEqual, "00123")
+		})
+	})
+}
+
+func TestJSONText(t *testing.T) {
+	conn, _ := connect()
+	defer conn.Close()
+	myconn := conn.(*flexmy.Connection)
+	textTable := "testjsontext"
+
+	cv.Convey("read JSON text of varchar column into struct", t, func() {
+		conn.DropTable(textTable)
+		_, err := myconn.DB().Exec("create table " + textTable + " (ID varchar(32) NOT NULL PRIMARY KEY, " +
+			"Address varchar(200), Tags varchar(200))")
+		cv.So(err, cv.ShouldBeNil)
+		_, err = myconn.DB().Exec("insert into " + textTable + " values ('T1', '{\"City\":\"Jakarta\",\"Zip\":\"00123\"}', '[\"a\"]')")
+		cv.So(err, cv.ShouldBeNil)
+
+		cur := conn.Cursor(dbflex.From(textTable).Select(), nil)
+		defer cur.Close()
+		objs := []jsonObject{}
+		cv.So(cur.Fetchs(&objs, 0), cv.ShouldBeNil)
+		cv.So(len(objs), cv.ShouldEqual, 1)
+		cv.So(objs[0].Address, cv.ShouldResemble, jsonAddress{"Jakarta", "00123"})
+		cv.So(objs[0].Tags, cv.ShouldResemble, []string{"a"})
+	})
+}
+
+func TestJSONPath(t *testing.T) {
+	conn, _ := connect()
+	defer conn.Close()
+	jsonTable := "testjson"
+
+	cv.Convey("filter on json path", t, func() {
+		cur := conn.Cursor(dbflex.From(jsonTable).Select("ID", "Attrs->$.color").Where(dbflex.Eq("Attrs->$.color", "red")), nil)
+		defer cur.Close()
+		cv.So(cur.Error(), cv.ShouldBeNil)
+		ms := []codekit.M{}
+		cv.So(cur.Fetchs(&ms, 0), cv.ShouldBeNil)
+		cv.So(len(ms), cv.ShouldEqual, 1)
+		cv.So(ms[0]["Attrs->$.color"], cv.ShouldEqual, "red")
+
+		cv.Convey("json contains and member of", func() {
+			cur := conn.Cursor(dbflex.From(jsonTable).Select().Where(dbflex.And(
+				flexmy.JSONContains("Attrs", codekit.M{}.Set("size", 10)),
+				flexmy.MemberOf("Tags", "a"),
+			)), nil)
+			defer cur.Close()
+			cv.So(cur.Error(), cv.ShouldBeNil)
+			cv.So(cur.Count(), cv.ShouldEqual, 1)
+		})
+	})
+}
+
+type taggedObject struct {
+	ID      string         `flexmy:"type=varchar(64);comment=object id"`
+	Email   string         `flexmy:"type=varchar(128);notnull;unique;collate=utf8mb4_bin"`
+	Name    string         `flexmy:"type=varchar(100);notnull;default='';index"`
+	Amount  flexmy.Decimal `flexmy:"type=decimal(18,2)"`
+	Created time.Time      `flexmy:"default=CURRENT_TIMESTAMP"`
+}
+
+func TestColumnTag(t *testing.T) {
+	conn, _ := connect()
+	defer conn.Close()
+	tagTable := "testtag"
+
+	cv.Convey("create table from tags", t, func() {
+		conn.DropTable(tagTable)
+		cv.So(conn.EnsureTable(tagTable, []string{"ID"}, new(taggedObject)), cv.ShouldBeNil)
+
+		data := &taggedObject{ID: "T1", Email: "a@b.c", Name: "Tagged", Amount: "12.50", Created: time.Now()}
+		_, err := conn.Execute(dbflex.From(tagTable).Insert(), codekit.M{}.Set("data", data))
+		cv.So(err, cv.ShouldBeNil)
+
+		cv.Convey("unique index is created", func() {
+			data.ID = "T2"
+			_, err := conn.Execute(dbflex.From(tagTable).Insert(), codekit.M{}.Set("data", data))
+			cv.So(flexmy.ErrorKind(err), cv.ShouldEqual, flexmy.ErrDuplicateKey)
+		})
+
+		cv.Convey("decimal is kept exactly", func() {
+			cur := conn.Cursor(dbflex.From(tagTable).Select(), nil)
+			defer cur.Close()
+			objs := []taggedObject{}
+			cv.So(cur.Fetchs(&objs, 0), cv.ShouldBeNil)
+			cv.So(len(objs), cv.ShouldEqual, 1)
+			cv.So(objs[0].Amount.String(), cv.ShouldEqual, "12.50")
+		})
+
+		cv.Convey("ensure again has nothing to alter", func() {
+			cv.So(conn.EnsureTable(tagTable, []string{"ID"}, new(taggedObject)), cv.ShouldBeNil)
+		})
+	})
+}
+
+type indexObject struct {
+	ID        string    `flexmy:"type=varchar(32)"`
+	DataGroup string    `flexmy:"type=varchar(32);index=ix_group_date"`
+	Date      time.Time `flexmy:"index=ix_group_date"`
+	Code      string    `flexmy:"type=varchar(32);unique"`
+	Title     string    `flexmy:"type=varchar(200);index;length=20"`
+	Notes     string    `flexmy:"type=text"`
+}
+
+func TestIndex(t *testing.T) {
+	conn, _ := connect()
+	defer conn.Close()
+	indexTable := "testindex"
+	ctx := context.Background()
+
+	cv.Convey("create declared indexes", t, func() {
+		conn.DropTable(indexTable)
+		opts := &flexmy.TableOptions{
+			Indexes: []flexmy.Index{{Name: "ft_notes", Columns: []string{"Notes"}, FullText: true}},
+		}
+		myconn := conn.(*flexmy.Connection)
+		res, err := myconn.EnsureTableWithOptions(ctx, indexTable, []string{"ID"}, new(indexObject), opts)
+		cv.So(err, cv.ShouldBeNil)
+		cv.So(len(res.Commands), cv.ShouldEqual, 1)
+		cv.So(res.Commands[0], cv.ShouldContainSubstring, "KEY ix_group_date (DataGroup,Date)")
+		cv.So(res.Commands[0], cv.ShouldContainSubstring, "KEY ix_Title (Title(20))")
+
+		cv.Convey("nothing to do when indexes match", func() {
+			res, err := myconn.EnsureTableWithOptions(ctx, indexTable, []string{"ID"}, new(indexObject), opts)
+			cv.So(err, cv.ShouldBeNil)
+			cv.So(len(res.Commands), cv.ShouldEqual, 0)
+			cv.So(len(res.StaleIndexes), cv.ShouldEqual, 0)
+
+			cv.Convey("report then drop stale index", func() {
+				res, err := myconn.EnsureTableWithOptions(ctx, indexTable, []string{"ID"}, new(indexObject), nil)
+				cv.So(err, cv.ShouldBeNil)
+				cv.So(res.StaleIndexes, cv.ShouldResemble, []string{"ft_notes"})
+
+				res, err = myconn.EnsureTableWithOptions(ctx, indexTable, []string{"ID"}, new(indexObject),
+					&flexmy.TableOptions{DropStaleIndexes: true})
+				cv.So(err, cv.ShouldBeNil)
+				cv.So(res.Commands[0], cv.ShouldContainSubstring, "drop index ft_notes")
+			})
+		})
+	})
+}
+
+type fkCustomer struct {
+	ID   string `flexmy:"type=varchar(32)"`
+	Name string
+}
+
+type fkOrder struct {
+	ID         string `flexmy:"type=varchar(32)"`
+	CustomerID string `flexmy:"type=varchar(32);fk=testfkcustomer(ID);ondelete=cascade"`
+	Amount     float64
+}
+
+func TestForeignKey(t *testing.T) {
+	conn, _ := connect()
+	defer conn.Close()
+	myconn := conn.(*flexmy.Connection)
+	ctx := context.Background()
+	tables := []flexmy.TableDef{
+		{Name: "testfkorder", Keys: []string{"ID"}, Obj: new(fkOrder)},
+		{Name: "testfkcustomer", Keys: []string{"ID"}, Obj: new(fkCustomer)},
+	}
+
+	cv.Convey("referenced table is created first", t, func() {
+		conn.DropTable("testfkorder")
+		conn.DropTable("testfkcustomer")
+		res, err := myconn.EnsureTables(ctx, tables...)
+		cv.So(err, cv.ShouldBeNil)
+		cv.So(res[0].Commands[0], cv.ShouldContainSubstring, "CONSTRAINT fk_testfkorder_CustomerID FOREIGN KEY (CustomerID) REFERENCES testfkcustomer (ID) ON DELETE CASCADE")
+
+		cv.Convey("constraint is enforced", func() {
+			_, err := conn.Execute(dbflex.From("testfkorder").Insert(), codekit.M{}.Set("data", &fkOrder{ID: "O1", CustomerID: "C1"}))
+			cv.So(flexmy.ErrorKind(err), cv.ShouldEqual, flexmy.ErrForeignKey)
+
+			_, err = conn.Execute(dbflex.From("testfkcustomer").Insert(), codekit.M{}.Set("data", &fkCustomer{ID: "C1", Name: "Customer 1"}))
+			cv.So(err, cv.ShouldBeNil)
+			_, err = conn.Execute(dbflex.From("testfkorder").Insert(), codekit.M{}.Set("data", &fkOrder{ID: "O1", CustomerID: "C1"}))
+			cv.So(err, cv.ShouldBeNil)
+
+			cv.Convey("ensure again has nothing to alter", func() {
+				res, err := myconn.EnsureTables(ctx, tables...)
+				cv.So(err, cv.ShouldBeNil)
+				cv.So(len(res[0].Commands), cv.ShouldEqual, 0)
+				cv.So(len(res[0].StaleIndexes), cv.ShouldEqual, 0)
+			})
+		})
+	})
+}
+
+type planObject struct {
+	ID   string `flexmy:"type=varchar(32)"`
+	Name string `flexmy:"type=varchar(100)"`
+}
+
+type planWiderObject struct {
+	ID   string `flexmy:"type=varchar(32)"`
+	Name string `flexmy:"type=varchar(200);index"`
+}
+
+type planNarrowerObject struct {
+	ID   string `flexmy:"type=varchar(32)"`
+	Name string `flexmy:"type=varchar(20)"`
+}
+
+func TestPlanTable(t *testing.T) {
+	conn, _ := connect()
+	defer conn.Close()
+	myconn := conn.(*flexmy.Connection)
+	planTable := "testplan"
+	ctx := context.Background()
+
+	cv.Convey("plan changes without running them", t, func() {
+		conn.DropTable(planTable)
+		plan, err := myconn.PlanTable(planTable, []string{"ID"}, new(planObject))
+		cv.So(err, cv.ShouldBeNil)
+		cv.So(plan.Create, cv.ShouldBeTrue)
+		cv.So(conn.EnsureTable(planTable, []string{"ID"}, new(planObject)), cv.ShouldBeNil)
+
+		plan, err = myconn.PlanTable(planTable, []string{"ID"}, new(planWiderObject))
+		cv.So(err, cv.ShouldBeNil)
+		cv.So(len(plan.Changes), cv.ShouldEqual, 2)
+		cv.So(plan.Changes[0].Kind, cv.ShouldEqual, flexmy.ChangeSafe)
+		cv.So(plan.Changes[1].Kind, cv.ShouldEqual, flexmy.ChangeSafe)
+		cv.So(len(plan.Lossy()), cv.ShouldEqual, 0)
+
+		plan, err = myconn.PlanTable(planTable, []string{"ID"}, new(planNarrowerObject))
+		cv.So(err, cv.ShouldBeNil)
+		cv.So(len(plan.Lossy()), cv.ShouldEqual, 1)
+		cv.So(plan.Lossy()[0].SQL, cv.ShouldEqual, "alter table testplan modify Name varchar(20)")
+
+		cv.Convey("lossy change is refused unless allowed", func() {
+			_, err := myconn.EnsureTableWithOptions(ctx, planTable, []string{"ID"}, new(planNarrowerObject),
+				&flexmy.TableOptions{RefuseLossy: true})
+			cv.So(errors.Is(err, flexmy.ErrLossyChange), cv.ShouldBeTrue)
+
+			_, err = myconn.EnsureTableWithOptions(ctx, planTable, []string{"ID"}, new(planNarrowerObject),
+				&flexmy.TableOptions{RefuseLossy: true, AllowLossy: true})
+			cv.So(err, cv.ShouldBeNil)
+		})
+	})
+}
+
+func TestMigration(t *testing.T) {
+	conn, _ := connect()
+	defer conn.Close()
+	myconn := conn.(*flexmy.Connection)
+	ctx := context.Background()
+
+	cv.Convey("apply migrations", t, func() {
+		myconn.Execute(dbflex.From(flexmy.MigrationTable).Delete(), nil)
+		conn.DropTable("testmigration")
+		err := myconn.RegisterMigration(
+			flexmy.Migration{Version: 1, Name: "create testmigration",
+				UpSQL:   "create table testmigration (ID varchar(32) NOT NULL PRIMARY KEY, Title varchar(100))",
+				DownSQL: "drop table testmigration"},
+			flexmy.Migration{Version: 2, Name: "add testmigration note",
+				Up: func(ctx context.Context, conn *flexmy.Connection) error {
+					_, err := conn.DB().ExecContext(ctx, "alter table testmigration add Note varchar(200)")
+					return err
+				},
+				Down: func(ctx context.Context, conn *flexmy.Connection) error {
+					_, err := conn.DB().ExecContext(ctx, "alter table testmigration drop Note")
+					return err
+				}},
+		)
+		cv.So(err, cv.ShouldBeNil)
+
+		applied, err := myconn.Migrate(ctx)
+		cv.So(err, cv.ShouldBeNil)
+		cv.So(applied, cv.ShouldResemble, []int64{1, 2})
+
+		cv.Convey("nothing pending on second run", func() {
+			applied, err := myconn.Migrate(ctx)
+			cv.So(err, cv.ShouldBeNil)
+			cv.So(len(applied), cv.ShouldEqual, 0)
+
+			cv.Convey("roll back to version 0", func() {
+				rolledBack, err := myconn.RollbackTo(ctx, 0)
+				cv.So(err, cv.ShouldBeNil)
+				cv.So(rolledBack, cv.ShouldResemble, []int64{2, 1})
+
+				history, err := myconn.AppliedMigrations(ctx)
+				cv.So(err, cv.ShouldBeNil)
+				cv.So(len(history), cv.ShouldEqual, 0)
+			})
+		})
+	})
+
+	cv.Convey("failed migration keeps the SQL error", t, func() {
+		failconn, _ := connect()
+		defer failconn.Close()
+		myfailconn := failconn.(*flexmy.Connection)
+		myfailconn.Execute(dbflex.From(flexmy.MigrationTable).Delete(), nil)
+		conn.DropTable("testmigration")
+
+		cv.So(myfailconn.RegisterMigration(flexmy.Migration{Version: 1, Name: "missing table",
+			UpSQL: "insert into testmigration (ID) values ('M1')"}), cv.ShouldBeNil)
+		_, err := myfailconn.Migrate(ctx)
+		cv.So(errors.Is(err, flexmy.ErrNoTable), cv.ShouldBeTrue)
+
+		var sqlErr *flexmy.Error
+		cv.So(errors.As(err, &sqlErr), cv.ShouldBeTrue)
+		cv.So(sqlErr.SQL, cv.ShouldEqual, "insert into testmigration (ID) values ('M1')")
+	})
+}
+
+type columnObject struct {
+	ID    string `flexmy:"type=varchar(32)"`
+	Title string `flexmy:"type=varchar(100)"`
+	Note  string `flexmy:"type=varchar(100)"`
+	Old   string `flexmy:"type=varchar(100)"`
+}
+
+type columnRenamedObject struct {
+	ID      string `flexmy:"type=varchar(32)"`
+	Note    string `flexmy:"type=varchar(100)"`
+	Title   string `flexmy:"type=varchar(100)"`
+	Caption string `flexmy:"type=varchar(100);was=Old"`
+}
+
+func TestColumnChange(t *testing.T) {
+	conn, _ := connect()
+	defer conn.Close()
+	myconn := conn.(*flexmy.Connection)
+	columnTable := "testcolumn"
+	ctx := context.Background()
+
+	cv.Convey("rename and reorder columns", t, func() {
+		conn.DropTable(columnTable)
+		cv.So(conn.EnsureTable(columnTable, []string{"ID"}, new(columnObject)), cv.ShouldBeNil)
+		_, err := conn.Execute(dbflex.From(columnTable).Insert(), codekit.M{}.Set("data", &columnObject{ID: "C1", Title: "Title", Old: "Kept"}))
+		cv.So(err, cv.ShouldBeNil)
+
+		res, err := myconn.EnsureTableWithOptions(ctx, columnTable, []string{"ID"}, new(columnRenamedObject),
+			&flexmy.TableOptions{ReorderColumns: true})
+		cv.So(err, cv.ShouldBeNil)
+		cv.So(res.Commands[0], cv.ShouldEqual, "alter table testcolumn rename column Old to Caption")
+
+		cur := conn.Cursor(dbflex.From(columnTable).Select(), nil)
+		defer cur.Close()
+		objs := []columnRenamedObject{}
+		cv.So(cur.Fetchs(&objs, 0), cv.ShouldBeNil)
+		cv.So(objs[0].Caption, cv.ShouldEqual, "Kept")
+
+		cv.Convey("columns are in order of the struct", func() {
+			plan, err := myconn.PlanTableWithOptions(ctx, columnTable, []string{"ID"}, new(columnRenamedObject),
+				&flexmy.TableOptions{ReorderColumns: true})
+			cv.So(err, cv.ShouldBeNil)
+			cv.So(len(plan.Changes), cv.ShouldEqual, 0)
+
+			cv.Convey("prune column on request", func() {
+				res, err := myconn.EnsureTableWithOptions(ctx, columnTable, []string{"ID"}, new(planObject), nil)
+				cv.So(err, cv.ShouldBeNil)
+				cv.So(len(res.StaleColumns), cv.ShouldEqual, 3)
+
+				res, err = myconn.EnsureTableWithOptions(ctx, columnTable, []string{"ID"}, new(planObject),
+					&flexmy.TableOptions{DropColumns: true})
+				cv.So(err, cv.ShouldBeNil)
+				cv.So(res.Commands[0], cv.ShouldContainSubstring, "drop column Caption")
+			})
+		})
+	})
+}
+
+type decimalObject struct {
+	ID       string
+	Dec      flexmy.Decimal  `flexmy:"type=decimal(18,6)"`
+	Zero     flexmy.Decimal  `flexmy:"type=decimal(18,6)"`
+	Nullable *flexmy.Decimal `flexmy:"type=decimal(18,6)"`
+	RatPtr   *big.Rat        `flexmy:"type=decimal(18,6)"`
+	Rat      big.Rat         `flexmy:"type=decimal(18,6)"`
+}
+
+func TestDecimal(t *testing.T) {
+	decimalTable := "testdecimal"
+	value := "123456789012.123456"
+	r, _ := new(big.Rat).SetString(value)
+
+	for _, uri := range []string{connString, connString + "?literal_sql=true"} {
+		conn, err := dbflex.NewConnectionFromURI(uri, nil)
+		if err != nil {
+			t.Fatalf("unable to connect. %s", err.Error())
+		}
+		conn.Connect()
+
+		cv.Convey("round-trip decimal(18,6) "+uri, t, func() {
+			conn.DropTable(decimalTable)
+			cv.So(conn.EnsureTable(decimalTable, []string{"ID"}, new(decimalObject)), cv.ShouldBeNil)
+
+			data := &decimalObject{ID: "D1", Dec: flexmy.Decimal(value), RatPtr: r, Rat: *r}
+			_, err := conn.Execute(dbflex.From(decimalTable).Insert(), codekit.M{}.Set("data", data))
+			cv.So(err, cv.ShouldBeNil)
+
+			cur := conn.Cursor(dbflex.From(decimalTable).Select(), nil)
+			defer cur.Close()
+			objs := []decimalObject{}
+			cv.So(cur.Fetchs(&objs, 0), cv.ShouldBeNil)
+			cv.So(len(objs), cv.ShouldEqual, 1)
+			cv.So(objs[0].Dec.String(), cv.ShouldEqual, value)
+			cv.So(objs[0].RatPtr.Cmp(r), cv.ShouldEqual, 0)
+			cv.So(objs[0].Rat.Cmp(r), cv.ShouldEqual, 0)
+
+			cv.Convey("decimal is kept exactly in M", func() {
+				cur := conn.Cursor(dbflex.From(decimalTable).Select(), nil)
+				defer cur.Close()
+				ms := []codekit.M{}
+				cv.So(cur.Fetchs(&ms, 0), cv.ShouldBeNil)
+				cv.So(len(ms), cv.ShouldEqual, 1)
+				cv.So(ms[0]["Dec"], cv.ShouldEqual, flexmy.Decimal(value))
+			})
+
+			cv.Convey("zero value is written as 0 and nil pointer as NULL", func() {
+				cv.So(objs[0].Zero.String(), cv.ShouldEqual, "0.000000")
+				cv.So(objs[0].Nullable, cv.ShouldBeNil)
+			})
+		})
+		conn.Close()
+	}
+}
+
+type typeObject struct {
+	ID     string
+	Amount float64
+	Count  int32
+	Active bool
+	Price  flexmy.Decimal
+	Date   time.Time
+}
+
+func TestTypeComparison(t *testing.T) {
+	conn, _ := connect()
+	defer conn.Close()
+	myconn := conn.(*flexmy.Connection)
+	typeTable := "testtype"
+
+	cv.Convey("types written differently are the same", t, func() {
+		conn.DropTable(typeTable)
+		_, err := myconn.DB().Exec("create table " + typeTable + " (ID varchar(200) NOT NULL PRIMARY KEY, " +
+			"Amount real, Count int(11), Active boolean, Price numeric(38,10), Date datetime(0))")
+		cv.So(err, cv.ShouldBeNil)
+
+		plan, err := myconn.PlanTable(typeTable, []string{"ID"}, new(typeObject))
+		cv.So(err, cv.ShouldBeNil)
+		cv.So(len(plan.Changes), cv.ShouldEqual, 0)
+
+		cv.Convey("ensure twice has nothing to alter", func() {
+			conn.DropTable(typeTable)
+			cv.So(conn.EnsureTable(typeTable, []string{"ID"}, new(typeObject)), cv.ShouldBeNil)
+			plan, err := myconn.PlanTable(typeTable, []string{"ID"}, new(typeObject))
+			cv.So(err, cv.ShouldBeNil)
+			cv.So(len(plan.Changes), cv.ShouldEqual, 0)
+		})
+	})
+}
+
+func TestOnlineSchemaChange(t *testing.T) {
+	conn, _ := connect()
+	defer conn.Close()
+	myconn := conn.(*flexmy.Connection)
+	onlineTable := "testonline"
+	ctx := context.Background()
+
+	cv.Convey("alter by shadow table copy", t, func() {
+		conn.DropTable(onlineTable)
+		cv.So(conn.EnsureTable(onlineTable, []string{"ID"}, new(planObject)), cv.ShouldBeNil)
+		objs := []*planObject{}
+		for i := 0; i < 25; i++ {
+			objs = append(objs, &planObject{ID: fmt.Sprintf("O%02d", i), Name: fmt.Sprintf("Name %d", i)})
+		}
+		_, err := conn.Execute(dbflex.From(onlineTable).Insert(), codekit.M{}.Set("data", objs))
+		cv.So(err, cv.ShouldBeNil)
+
+		res, err := myconn.EnsureTableWithOptions(ctx, onlineTable, []string{"ID"}, new(planWiderObject),
+			&flexmy.TableOptions{Online: flexmy.OnlineShadowCopy, ChunkSize: 10})
+		cv.So(err, cv.ShouldBeNil)
+		cv.So(res.Commands[len(res.Commands)-2], cv.ShouldEqual, "rename table testonline to testonline_old, testonline_new to testonline")
+
+		cur := conn.Cursor(dbflex.From(onlineTable).Select(), nil)
+		defer cur.Close()
+		cv.So(cur.Count(), cv.ShouldEqual, 25)
+
+		res, err = myconn.EnsureTableWithOptions(ctx, onlineTable, []string{"ID"}, new(planWiderObject),
+			&flexmy.TableOptions{Online: flexmy.OnlineShadowCopy, ChunkSize: 10})
+		cv.So(err, cv.ShouldBeNil)
+		cv.So(len(res.Commands), cv.ShouldEqual, 0)
+
+		cv.Convey("alter in place", func() {
+			res, err := myconn.EnsureTableWithOptions(ctx, onlineTable, []string{"ID"}, new(columnObject),
+				&flexmy.TableOptions{Online: flexmy.OnlineAuto})
+			cv.So(err, cv.ShouldBeNil)
+			cv.So(res.Commands[0], cv.ShouldEndWith, "ALGORITHM=INPLACE, LOCK=NONE")
+		})
+	})
+}
@@ -0,0 +1,97 @@
+package flexmy
+
+import (
+	"database/sql/driver"
+	"fmt"
+	"math/big"
+	"strings"
+)
+
+// Decimal is exact decimal number kept as its text. Use it, or *big.Rat, for DECIMAL column
+// that should round-trip without float conversion. Its zero value is written as 0,
+// use *Decimal for nullable column
+type Decimal string
+
+// String returns text of the decimal
+func (d Decimal) String() string {
+	return string(d)
+}
+
+// Rat returns d as big.Rat, false if d is not a valid number
+func (d Decimal) Rat() (*big.Rat, bool) {
+	return new(big.Rat).SetString(string(d))
+}
+
+// Value implements driver.Valuer, decimal is sent as text so server converts it exactly
+func (d Decimal) Value() (driver.Value, error) {
+	if d == "" {
+		return "0", nil
+	}
+	if _, ok := d.Rat(); !ok {
+		return nil, fmt.Errorf("invalid decimal %s", string(d))
+	}
+	return string(d), nil
+}
+
+// Scan implements sql.Scanner
+func (d *Decimal) Scan(value interface{}) error {
+	switch value.(type) {
+	case nil:
+		*d = ""
+	case []byte:
+		*d = Decimal(value.([]byte))
+	case string:
+		*d = Decimal(value.(string))
+	default:
+		*d = Decimal(fmt.Sprintf("%v", value))
+	}
+	return nil
+}
+
+// maxDecimalScale is maximum scale of MySQL DECIMAL
+const maxDecimalScale = 30
+
+// ratString formats r as decimal text, r that is not a finite decimal is rounded to maxDecimalScale digits
+func ratString(r *big.Rat) string {
+	if r.IsInt() {
+		return r.Num().String()
+	}
+	s := r.FloatString(maxDecimalScale)
+	s = strings.TrimRight(s, "0")
+	return strings.TrimSuffix(s, ".")
+}
+
+// isDecimalType check if typeName is a type decoded by castDecimal
+func isDecimalType(typeName string) bool {
+	return typeName == "flexmy.Decimal" || typeName == "big.Rat" || typeName == "*big.Rat"
+}
+
+// castDecimal converts value of decimal column into typeName without float conversion
+func castDecimal(value interface{}, typeName string) (interface{}, error) {
+	if isNullValue(value) {
+		switch typeName {
+		case "flexmy.Decimal":
+			return Decimal(""), nil
+		case "big.Rat":
+			return big.Rat{}, nil
+		}
+		return nil, nil
+	}
+
+	v := fmt.Sprintf("%v", value)
+	if b, ok := value.([]byte); ok {
+		v = string(b)
+	}
+	if typeName == "flexmy.Decimal" {
+		return Decimal(v), nil
+	}
+
+	r, ok := new(big.Rat).SetString(v)
+	if !ok {
+		return nil, fmt.Errorf("invalid decimal %s", v)
+	}
+	if typeName == "big.Rat" {
+		return *r, nil
+	}
+	return r, nil
+}
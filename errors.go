@@ -0,0 +1,84 @@
+package flexmy
+
+import (
+	"errors"
+
+	"github.com/go-sql-driver/mysql"
+)
+
+// Errors classifying MySQL error numbers, use them with errors.Is
+var (
+	ErrDuplicateKey       = errors.New("duplicate key")
+	ErrForeignKey         = errors.New("foreign key constraint fails")
+	ErrNoTable            = errors.New("table does not exist")
+	ErrNoColumn           = errors.New("column does not exist")
+	ErrDeadlock           = errors.New("deadlock found")
+	ErrLockWaitTimeout    = errors.New("lock wait timeout exceeded")
+	ErrLockNotAvailable   = errors.New("lock could not be acquired immediately")
+	ErrDataTooLong        = errors.New("data too long for column")
+	ErrNotNull            = errors.New("column can not be null")
+	ErrQueryInterrupted   = errors.New("query execution was interrupted")
+	ErrReadOnlyTx         = errors.New("cannot execute statement in a read only transaction")
+	ErrPacketTooLarge     = errors.New("packet bigger than max_allowed_packet")
+	ErrTruncatedWrongData = errors.New("incorrect or truncated value")
+)
+
+// ErrLossyChange is returned by EnsureTable refusing a schema change that could lose data
+var ErrLossyChange = errors.New("lossy schema change")
+
+var errorNumbers = map[uint16]error{
+	1062: ErrDuplicateKey,
+	1586: ErrDuplicateKey,
+	1216: ErrForeignKey,
+	1217: ErrForeignKey,
+	1451: ErrForeignKey,
+	1452: ErrForeignKey,
+	1146: ErrNoTable,
+	1054: ErrNoColumn,
+	1213: ErrDeadlock,
+	1205: ErrLockWaitTimeout,
+	3572: ErrLockNotAvailable,
+	1406: ErrDataTooLong,
+	1048: ErrNotNull,
+	1317: ErrQueryInterrupted,
+	1792: ErrReadOnlyTx,
+	1153: ErrPacketTooLarge,
+	1292: ErrTruncatedWrongData,
+	1366: ErrTruncatedWrongData,
+}
+
+// Error is error of a SQL command. It wraps the original error and keeps the command separately.
+// errors.Is matches its kind and errors.As could reach the original *mysql.MySQLError
+type Error struct {
+	Kind error
+	SQL  string
+	Err  error
+}
+
+func (e *Error) Error() string {
+	return e.Err.Error() + ". SQL Command: " + e.SQL
+}
+
+// Unwrap returns the original error
+func (e *Error) Unwrap() error {
+	return e.Err
+}
+
+// Is reports whether target is kind of the error
+func (e *Error) Is(target error) bool {
+	return e.Kind != nil && e.Kind == target
+}
+
+// newSQLError wraps err of running cmdtxt
+func newSQLError(err error, cmdtxt string) error {
+	return &Error{Kind: ErrorKind(err), SQL: cmdtxt, Err: err}
+}
+
+// ErrorKind returns classification of err based on its MySQL error number, nil if it is not a known MySQL error
+func ErrorKind(err error) error {
+	var myErr *mysql.MySQLError
+	if !errors.As(err, &myErr) {
+		return nil
+	}
+	return errorNumbers[myErr.Number]
+}
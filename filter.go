@@ -0,0 +1,186 @@
+package flexmy
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+
+	"git.kanosolution.net/kano/dbflex"
+)
+
+// BuildFilter translate dbflex filter into where clause of MySQL. Values are written as ? placeholders
+// and collected to be passed to database/sql, unless query is running in literal SQL mode.
+// Field could address JSON path using column->$.path syntax
+func (q *Query) BuildFilter(f *dbflex.Filter) (interface{}, error) {
+	q.filterArgs = []interface{}{}
+	where, err := q.buildFilter(f)
+	if err != nil {
+		return nil, err
+	}
+	return where, nil
+}
+
+func (q *Query) buildFilter(f *dbflex.Filter) (string, error) {
+	field := jsonFieldSQL(f.Field)
+	switch f.Op {
+	case dbflex.OpAnd, dbflex.OpOr:
+		items := []string{}
+		for _, item := range f.Items {
+			txt, err := q.buildFilter(item)
+			if err != nil {
+				return "", err
+			}
+			items = append(items, txt)
+		}
+		if len(items) == 0 {
+			return "1=1", nil
+		}
+		separator := " AND "
+		if f.Op == dbflex.OpOr {
+			separator = " OR "
+		}
+		return "(" + strings.Join(items, separator) + ")", nil
+
+	case dbflex.OpNot:
+		if len(f.Items) == 0 {
+			return "", fmt.Errorf("not filter should have an item")
+		}
+		txt, err := q.buildFilter(f.Items[0])
+		if err != nil {
+			return "", err
+		}
+		return "NOT (" + txt + ")", nil
+
+	case dbflex.OpEq:
+		if derefValue(f.Value) == nil {
+			return field + " IS NULL", nil
+		}
+		return q.filterOperand(field, "=", f.Value), nil
+
+	case dbflex.OpNe:
+		if derefValue(f.Value) == nil {
+			return field + " IS NOT NULL", nil
+		}
+		return q.filterOperand(field, "<>", f.Value), nil
+
+	case dbflex.OpGt:
+		return q.filterOperand(field, ">", f.Value), nil
+
+	case dbflex.OpGte:
+		return q.filterOperand(field, ">=", f.Value), nil
+
+	case dbflex.OpLt:
+		return q.filterOperand(field, "<", f.Value), nil
+
+	case dbflex.OpLte:
+		return q.filterOperand(field, "<=", f.Value), nil
+
+	case dbflex.OpIn, dbflex.OpNin:
+		values := sliceValues(f.Value)
+		if len(values) == 0 {
+			if f.Op == dbflex.OpIn {
+				return "1=0", nil
+			}
+			return "1=1", nil
+		}
+		op := "IN"
+		if f.Op == dbflex.OpNin {
+			op = "NOT IN"
+		}
+		return fmt.Sprintf("%s %s (%s)", field, op, q.placeholders(values...)), nil
+
+	case dbflex.OpRange:
+		values := sliceValues(f.Value)
+		if len(values) != 2 {
+			return "", fmt.Errorf("range filter of %s should have 2 values", f.Field)
+		}
+		return fmt.Sprintf("%s BETWEEN %s AND %s", field, q.placeholders(values[0]), q.placeholders(values[1])), nil
+
+	case dbflex.OpContains:
+		items := []string{}
+		for _, v := range sliceValues(f.Value) {
+			items = append(items, q.filterOperand(field, "LIKE", fmt.Sprintf("%%%v%%", v)))
+		}
+		if len(items) == 0 {
+			return "1=1", nil
+		}
+		return "(" + strings.Join(items, " OR ") + ")", nil
+
+	case dbflex.OpStartWith:
+		return q.filterOperand(field, "LIKE", fmt.Sprintf("%v%%", f.Value)), nil
+
+	case dbflex.OpEndWith:
+		return q.filterOperand(field, "LIKE", fmt.Sprintf("%%%v", f.Value)), nil
+
+	case OpJSONContains:
+		column, path, isPath := splitJSONPath(f.Field)
+		if !isPath {
+			return fmt.Sprintf("JSON_CONTAINS(%s, %s)", column, q.placeholders(jsonText(f.Value))), nil
+		}
+		return fmt.Sprintf("JSON_CONTAINS(%s, %s, '%s')", column, q.placeholders(jsonText(f.Value)), CleanupSQL(path)), nil
+
+	case OpMemberOf:
+		column, path, isPath := splitJSONPath(f.Field)
+		if isPath {
+			column = fmt.Sprintf("JSON_EXTRACT(%s, '%s')", column, CleanupSQL(path))
+		}
+		return fmt.Sprintf("%s MEMBER OF(%s)", q.placeholders(f.Value), column), nil
+	}
+
+	return "", fmt.Errorf("filter operation %s is not supported", f.Op)
+}
+
+func (q *Query) filterOperand(field, op string, value interface{}) string {
+	return fmt.Sprintf("%s %s %s", field, op, q.placeholders(value))
+}
+
+// placeholders returns comma separated ? for each of values and register them as filter arguments.
+// In literal SQL mode values are written as literal instead
+func (q *Query) placeholders(values ...interface{}) string {
+	marks := make([]string, len(values))
+	for idx, v := range values {
+		if q.literalSQL {
+			marks[idx] = q.ValueToSQlValue(v)
+			continue
+		}
+		marks[idx] = "?"
+		q.filterArgs = append(q.filterArgs, q.valueToArg(v))
+	}
+	return strings.Join(marks, ",")
+}
+
+func sliceValues(v interface{}) []interface{} {
+	rv := reflect.ValueOf(v)
+	if rv.Kind() != reflect.Slice && rv.Kind() != reflect.Array {
+		if v == nil {
+			return []interface{}{}
+		}
+		return []interface{}{v}
+	}
+	out := make([]interface{}, rv.Len())
+	for idx := range out {
+		out[idx] = rv.Index(idx).Interface()
+	}
+	return out
+}
+
+// equalityFields returns lowercased name of fields compared with equal operation, the filter
+// should be a single equal filter or and-ed of them, otherwise nil is returned
+func equalityFields(f *dbflex.Filter) []string {
+	switch f.Op {
+	case dbflex.OpEq:
+		return []string{strings.ToLower(f.Field)}
+
+	case dbflex.OpAnd:
+		fields := []string{}
+		for _, item := range f.Items {
+			itemFields := equalityFields(item)
+			if itemFields == nil {
+				return nil
+			}
+			fields = append(fields, itemFields...)
+		}
+		return fields
+	}
+	return nil
+}
@@ -1 +1,161 @@
 package flexmy
+
+import (
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// ConfigLiteralSQL is ServerInfo config key, when it is true values are written into SQL command
+	// as literal instead of being passed as ? arguments. It is meant for debugging only
+	ConfigLiteralSQL = "literal_sql"
+
+	// ConfigGuessType is ServerInfo config key, when it is true cursor guesses type of value from its content
+	// instead of using type of its column when fetching into codekit.M
+	ConfigGuessType = "guess_type"
+
+	// ConfigStoreLocation is ServerInfo config key of time zone used to store DATETIME, ie UTC or Asia/Jakarta.
+	// Time values are converted into it on write and read back in it. When it is not set, loc of the DSN is used
+	// if parseTime is set, otherwise Local
+	ConfigStoreLocation = "store_loc"
+
+	// ConfigTimePrecision is ServerInfo config key of fractional second digits (0-6) of time columns
+	// created by EnsureTable, 6 keeps microsecond. Default is 0
+	ConfigTimePrecision = "time_precision"
+
+	// ConfigTimeType is ServerInfo config key of column type created by EnsureTable for time fields,
+	// datetime (default) or timestamp
+	ConfigTimeType = "time_type"
+
+	// ConfigRefuseLossy is ServerInfo config key, when it is true EnsureTable refuses lossy change of existing
+	// columns with ErrLossyChange. Use EnsureTableWithOptions with AllowLossy to run them
+	ConfigRefuseLossy = "refuse_lossy"
+)
+
+// timeLayout is layout to write and read DATETIME and TIMESTAMP including microsecond
+const timeLayout = "2006-01-02 15:04:05.999999"
+
+const (
+	// ConfigLock is query config key, or key of Cursor input, to append locking clause into select command.
+	// Value is one of LockMode and the cursor should be run inside transaction
+	ConfigLock = "flexmy_lock"
+)
+
+// LockMode is row locking clause of select command
+type LockMode string
+
+const (
+	LockForUpdate           LockMode = "FOR UPDATE"
+	LockForUpdateNoWait     LockMode = "FOR UPDATE NOWAIT"
+	LockForUpdateSkipLocked LockMode = "FOR UPDATE SKIP LOCKED"
+
+	// LockForShare and its variants need MySQL 8, use LockInShareMode for older server
+	LockForShare           LockMode = "FOR SHARE"
+	LockForShareNoWait     LockMode = "FOR SHARE NOWAIT"
+	LockForShareSkipLocked LockMode = "FOR SHARE SKIP LOCKED"
+	LockInShareMode        LockMode = "LOCK IN SHARE MODE"
+)
+
+var lockModes = []LockMode{
+	LockForUpdate, LockForUpdateNoWait, LockForUpdateSkipLocked,
+	LockForShare, LockForShareNoWait, LockForShareSkipLocked, LockInShareMode,
+}
+
+// driverConfigKeys are ServerInfo config keys consumed by flexmy, they are not passed to mysql DSN
+var driverConfigKeys = []string{
+	ConfigLiteralSQL,
+	ConfigGuessType,
+	ConfigStoreLocation,
+	ConfigTimePrecision,
+	ConfigTimeType,
+	ConfigRefuseLossy,
+}
+
+func isDriverConfig(key string) bool {
+	for _, k := range driverConfigKeys {
+		if strings.ToLower(key) == k {
+			return true
+		}
+	}
+	return false
+}
+
+func configBool(v interface{}) bool {
+	switch v.(type) {
+	case bool:
+		return v.(bool)
+	case string:
+		s := strings.ToLower(v.(string))
+		return s == "true" || s == "1" || s == "yes"
+	case int:
+		return v.(int) != 0
+	}
+	return false
+}
+
+func configString(v interface{}) string {
+	if v == nil {
+		return ""
+	}
+	return fmt.Sprintf("%v", v)
+}
+
+// storeLocation returns time zone used to store time values of the connection
+func (c *Connection) storeLocation() *time.Location {
+	name := configString(c.Config[ConfigStoreLocation])
+	if name == "" && configBool(c.Config["parseTime"]) {
+		// go-sql-driver parses time in loc, which is UTC by default
+		name = "UTC"
+		if loc := configString(c.Config["loc"]); loc != "" {
+			name, _ = url.QueryUnescape(loc)
+		}
+	}
+	if name == "" || name == "Local" {
+		return time.Local
+	}
+	loc, err := time.LoadLocation(name)
+	if err != nil {
+		return time.Local
+	}
+	return loc
+}
+
+// timePrecision returns fractional second digits of time columns based on ConfigTimePrecision
+func (c *Connection) timePrecision() int {
+	precision, err := strconv.Atoi(configString(c.Config[ConfigTimePrecision]))
+	if err != nil || precision < 0 {
+		return 0
+	}
+	if precision > 6 {
+		return 6
+	}
+	return precision
+}
+
+// timeDataType returns column type of time fields based on ConfigTimeType and ConfigTimePrecision
+func (c *Connection) timeDataType() string {
+	dataType := "datetime"
+	if strings.ToLower(configString(c.Config[ConfigTimeType])) == "timestamp" {
+		dataType = "timestamp"
+	}
+	if precision := c.timePrecision(); precision > 0 {
+		dataType = fmt.Sprintf("%s(%d)", dataType, precision)
+	}
+	return dataType
+}
+
+// formatTime formats t in loc as MySQL datetime text. Fractional second is truncated into precision digits,
+// otherwise MySQL rounds it and the stored time could move to the next second, or day
+func formatTime(t time.Time, loc *time.Location, precision int) string {
+	if loc != nil {
+		t = t.In(loc)
+	}
+	unit := time.Second
+	for idx := 0; idx < precision && idx < 6; idx++ {
+		unit /= 10
+	}
+	return t.Truncate(unit).Format(timeLayout)
+}
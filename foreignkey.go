@@ -0,0 +1,230 @@
+package flexmy
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// ForeignKey is FOREIGN KEY constraint of a table. On struct field it is declared by TagName tag, ie
+// `flexmy:"fk=customer(id);ondelete=cascade;onupdate=restrict"`
+type ForeignKey struct {
+	// Name defaults to fk_<table>_<column>, constraint name should be unique within the schema
+	Name       string
+	Columns    []string
+	RefTable   string
+	RefColumns []string
+
+	// OnDelete and OnUpdate are referential action: RESTRICT, CASCADE, SET NULL or NO ACTION
+	OnDelete string
+	OnUpdate string
+}
+
+// definition returns constraint definition used by create and alter table
+func (fk ForeignKey) definition() string {
+	def := fmt.Sprintf("CONSTRAINT %s FOREIGN KEY (%s) REFERENCES %s (%s)",
+		fk.Name, strings.Join(fk.Columns, ","), fk.RefTable, strings.Join(fk.RefColumns, ","))
+	if fk.OnDelete != "" {
+		def += " ON DELETE " + strings.ToUpper(fk.OnDelete)
+	}
+	if fk.OnUpdate != "" {
+		def += " ON UPDATE " + strings.ToUpper(fk.OnUpdate)
+	}
+	return def
+}
+
+// sameAs check if fk and other reference the same columns with the same actions
+func (fk ForeignKey) sameAs(other ForeignKey) bool {
+	return strings.EqualFold(fk.RefTable, other.RefTable) &&
+		sameNames(fk.Columns, other.Columns) &&
+		sameNames(fk.RefColumns, other.RefColumns) &&
+		referentialAction(fk.OnDelete) == referentialAction(other.OnDelete) &&
+		referentialAction(fk.OnUpdate) == referentialAction(other.OnUpdate)
+}
+
+// referentialAction normalizes action, InnoDB treats NO ACTION and omitted action as RESTRICT
+func referentialAction(action string) string {
+	action = strings.ToUpper(strings.TrimSpace(action))
+	if action == "" || action == "NO ACTION" {
+		return "RESTRICT"
+	}
+	return action
+}
+
+func sameNames(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for idx := range a {
+		if !strings.EqualFold(a[idx], b[idx]) {
+			return false
+		}
+	}
+	return true
+}
+
+var fkReference = regexp.MustCompile(`^\s*(\w+)\s*\(([^)]*)\)\s*$`)
+
+// parseReference parses table(column,...) of fk tag, without columns the reference uses column itself
+func parseReference(ref, column string) (string, []string) {
+	matches := fkReference.FindStringSubmatch(ref)
+	if matches == nil {
+		return strings.TrimSpace(ref), []string{column}
+	}
+	columns := []string{}
+	for _, refColumn := range strings.Split(matches[2], ",") {
+		columns = append(columns, strings.TrimSpace(refColumn))
+	}
+	return matches[1], columns
+}
+
+// tableForeignKeys reads FOREIGN KEY constraints of table from information_schema
+func (c *Connection) tableForeignKeys(ctx context.Context, name string) ([]ForeignKey, error) {
+	cmd := "select k.constraint_name, k.column_name, k.referenced_table_name, k.referenced_column_name, r.delete_rule, r.update_rule " +
+		"from information_schema.KEY_COLUMN_USAGE k join information_schema.REFERENTIAL_CONSTRAINTS r " +
+		"on r.constraint_schema=k.constraint_schema and r.constraint_name=k.constraint_name and r.table_name=k.table_name " +
+		"where k.table_schema=database() and lower(k.table_name)=? and k.referenced_table_name is not null " +
+		"order by k.constraint_name, k.ordinal_position"
+	rows, err := c.db.QueryContext(ctx, cmd, strings.ToLower(name))
+	if err != nil {
+		return nil, fmt.Errorf("unable to read foreign keys of %s. %s", name, err.Error())
+	}
+	defer rows.Close()
+
+	fks := []ForeignKey{}
+	for rows.Next() {
+		var constraintName, columnName, refTable, refColumn, onDelete, onUpdate string
+		if err = rows.Scan(&constraintName, &columnName, &refTable, &refColumn, &onDelete, &onUpdate); err != nil {
+			return nil, fmt.Errorf("unable to read foreign keys of %s. %s", name, err.Error())
+		}
+		if len(fks) == 0 || fks[len(fks)-1].Name != constraintName {
+			fks = append(fks, ForeignKey{Name: constraintName, RefTable: refTable, OnDelete: onDelete, OnUpdate: onUpdate})
+		}
+		fk := &fks[len(fks)-1]
+		fk.Columns = append(fk.Columns, columnName)
+		fk.RefColumns = append(fk.RefColumns, refColumn)
+	}
+	return fks, rows.Err()
+}
+
+// foreignKeyDrops adds dropping of changed and stale constraints into plan. Constraint has to be dropped
+// in a statement before it is added again, so drops are run first
+func foreignKeyDrops(plan *TablePlan, declared, existing []ForeignKey, dropStale bool) {
+	declaredKeys := map[string]ForeignKey{}
+	for _, fk := range declared {
+		declaredKeys[strings.ToLower(fk.Name)] = fk
+	}
+
+	for _, current := range existing {
+		fk, isDeclared := declaredKeys[strings.ToLower(current.Name)]
+		if isDeclared && !current.sameAs(fk) {
+			plan.addChange(ChangeIndexRebuild, "drop foreign key "+current.Name, "rebuild foreign key "+current.Name, true)
+			continue
+		}
+		if !isDeclared {
+			plan.StaleForeignKeys = append(plan.StaleForeignKeys, current.Name)
+			if dropStale {
+				plan.addChange(ChangeIndexRebuild, "drop foreign key "+current.Name, "drop foreign key "+current.Name, true)
+			}
+		}
+	}
+}
+
+// foreignKeyAdds adds new and changed constraints into plan
+func foreignKeyAdds(plan *TablePlan, declared, existing []ForeignKey) {
+	existingKeys := map[string]ForeignKey{}
+	for _, fk := range existing {
+		existingKeys[strings.ToLower(fk.Name)] = fk
+	}
+
+	for _, fk := range declared {
+		current, exists := existingKeys[strings.ToLower(fk.Name)]
+		if exists && current.sameAs(fk) {
+			continue
+		}
+		kind := ChangeSafe
+		if exists {
+			kind = ChangeIndexRebuild
+		}
+		plan.addChange(kind, "add "+fk.definition(), "add foreign key "+fk.Name, false)
+	}
+}
+
+// TableDef is a table to be ensured by EnsureTables
+type TableDef struct {
+	Name    string
+	Keys    []string
+	Obj     interface{}
+	Options *TableOptions
+}
+
+// EnsureTables ensures several tables, referenced tables are ensured before tables referencing them.
+// Tables without dependency between them keep the given order. Results are returned in the given order
+func (c *Connection) EnsureTables(ctx context.Context, tables ...TableDef) ([]*TableResult, error) {
+	order, err := c.tableOrder(tables)
+	if err != nil {
+		return nil, err
+	}
+
+	results := make([]*TableResult, len(tables))
+	for _, idx := range order {
+		t := tables[idx]
+		results[idx], err = c.EnsureTableWithOptions(ctx, t.Name, t.Keys, t.Obj, t.Options)
+		if err != nil {
+			return results, err
+		}
+	}
+	return results, nil
+}
+
+// tableOrder sorts tables topologically by their foreign keys, it fails on circular reference
+func (c *Connection) tableOrder(tables []TableDef) ([]int, error) {
+	positions := map[string]int{}
+	for idx, t := range tables {
+		positions[strings.ToLower(t.Name)] = idx
+	}
+
+	dependencies := make([][]int, len(tables))
+	for idx, t := range tables {
+		spec := newTableSpec(t.Name, t.Keys, t.Obj, t.Options, c)
+		for _, fk := range spec.ForeignKeys {
+			if pos, ok := positions[strings.ToLower(fk.RefTable)]; ok && pos != idx {
+				dependencies[idx] = append(dependencies[idx], pos)
+			}
+		}
+	}
+
+	const (
+		unvisited = iota
+		visiting
+		visited
+	)
+	states := make([]int, len(tables))
+	order := []int{}
+	var visit func(idx int) error
+	visit = func(idx int) error {
+		switch states[idx] {
+		case visited:
+			return nil
+		case visiting:
+			return fmt.Errorf("circular foreign key reference on table %s", tables[idx].Name)
+		}
+		states[idx] = visiting
+		for _, dep := range dependencies[idx] {
+			if err := visit(dep); err != nil {
+				return err
+			}
+		}
+		states[idx] = visited
+		order = append(order, idx)
+		return nil
+	}
+
+	for idx := range tables {
+		if err := visit(idx); err != nil {
+			return nil, err
+		}
+	}
+	return order, nil
+}
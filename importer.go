@@ -0,0 +1,253 @@
+package flexmy
+
+import (
+	"bufio"
+	"context"
+	"database/sql"
+	"fmt"
+	"io"
+	"reflect"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/go-sql-driver/mysql"
+	"github.com/sebarcode/codekit"
+)
+
+var importSeq int64
+
+// ImportOptions define how data is loaded by LOAD DATA LOCAL INFILE
+type ImportOptions struct {
+	// Fields are columns in the same order as the data. For ImportChan it is taken from the struct when empty,
+	// otherwise only the given columns are written in the given order, they should match column of struct fields
+	Fields []string
+
+	// FieldsTerminatedBy defaults to tab
+	FieldsTerminatedBy string
+
+	// LinesTerminatedBy defaults to new line
+	LinesTerminatedBy string
+
+	// IgnoreLines is number of header lines to be skipped
+	IgnoreLines int
+
+	// Replace replaces existing rows with same unique key, otherwise Ignore skips them.
+	// When both are false duplicate key will be reported as warning
+	Replace bool
+	Ignore  bool
+}
+
+// ImportWarning is a warning raised by the server while loading data
+type ImportWarning struct {
+	Level   string
+	Code    int
+	Message string
+}
+
+// ImportResult is result of an import
+type ImportResult struct {
+	RowsLoaded int64
+	Warnings   []ImportWarning
+}
+
+// ImportReader streams r into table using LOAD DATA LOCAL INFILE. Server should have local_infile enabled
+func (c *Connection) ImportReader(ctx context.Context, tableName string, r io.Reader, opts *ImportOptions) (*ImportResult, error) {
+	if opts == nil {
+		opts = new(ImportOptions)
+	}
+
+	name := fmt.Sprintf("flexmy_import_%d", atomic.AddInt64(&importSeq, 1))
+	mysql.RegisterReaderHandler(name, func() io.Reader {
+		return r
+	})
+	defer mysql.DeregisterReaderHandler(name)
+
+	cmdtxt := loadDataCommand(name, tableName, opts)
+	if c.tx != nil {
+		return c.loadData(ctx, c.tx, cmdtxt)
+	}
+
+	conn, err := c.db.Conn(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	return c.loadData(ctx, conn, cmdtxt)
+}
+
+// ImportChan loads every struct received from ch into table using LOAD DATA LOCAL INFILE until ch is closed.
+// ch should be a channel of struct or pointer to struct, columns are mapped using the same alias used by EnsureTable.
+// When import fails, remaining items are received and discarded until ch is closed, so its producer is not blocked.
+// Once ctx is done ch is no longer received, producer should stop sending on ctx too
+func (c *Connection) ImportChan(ctx context.Context, tableName string, ch interface{}, opts *ImportOptions) (*ImportResult, error) {
+	chv := reflect.ValueOf(ch)
+	if chv.Kind() != reflect.Chan {
+		return nil, fmt.Errorf("import source should be a channel, got %s", chv.Kind().String())
+	}
+	t := chv.Type().Elem()
+	if t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	if t.Kind() != reflect.Struct {
+		return nil, fmt.Errorf("import channel should be channel of struct, got %s", t.String())
+	}
+
+	fieldIndexes := []int{}
+	fields := []string{}
+	columnIndexes := map[string]int{}
+	for idx := 0; idx < t.NumField(); idx++ {
+		ft := t.Field(idx)
+		name := columnName(ft)
+		if name == "-" || ft.PkgPath != "" {
+			continue
+		}
+		fieldIndexes = append(fieldIndexes, idx)
+		fields = append(fields, name)
+		columnIndexes[strings.ToLower(name)] = idx
+	}
+
+	chanOpts := ImportOptions{Fields: fields}
+	if opts != nil {
+		chanOpts.Replace = opts.Replace
+		chanOpts.Ignore = opts.Ignore
+		if len(opts.Fields) > 0 {
+			fieldIndexes = []int{}
+			for _, name := range opts.Fields {
+				idx, ok := columnIndexes[strings.ToLower(name)]
+				if !ok {
+					return nil, fmt.Errorf("import field %s is not a field of %s", name, t.String())
+				}
+				fieldIndexes = append(fieldIndexes, idx)
+			}
+			chanOpts.Fields = opts.Fields
+		}
+	}
+
+	// recv receives next item of ch, it returns false when ch is closed or ctx is done
+	cases := []reflect.SelectCase{
+		{Dir: reflect.SelectRecv, Chan: reflect.ValueOf(ctx.Done())},
+		{Dir: reflect.SelectRecv, Chan: chv},
+	}
+	recv := func() (reflect.Value, bool) {
+		chosen, item, ok := reflect.Select(cases)
+		return item, chosen == 1 && ok
+	}
+
+	loc, precision := c.storeLocation(), c.timePrecision()
+	pr, pw := io.Pipe()
+	go func() {
+		w := bufio.NewWriter(pw)
+		for {
+			item, ok := recv()
+			if !ok {
+				break
+			}
+			item = reflect.Indirect(item)
+			if !item.IsValid() {
+				continue
+			}
+			values := make([]string, len(fieldIndexes))
+			for idx, fieldIndex := range fieldIndexes {
+				values[idx] = importValue(item.Field(fieldIndex).Interface(), loc, precision)
+			}
+			if _, err := w.WriteString(strings.Join(values, "\t") + "\n"); err != nil {
+				pw.CloseWithError(err)
+				for _, ok := recv(); ok; _, ok = recv() {
+				}
+				return
+			}
+		}
+		if err := ctx.Err(); err != nil {
+			pw.CloseWithError(err)
+			return
+		}
+		pw.CloseWithError(w.Flush())
+	}()
+	defer pr.Close()
+
+	return c.ImportReader(ctx, tableName, pr, &chanOpts)
+}
+
+type execQuerier interface {
+	ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error)
+	QueryContext(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error)
+}
+
+// loadData runs LOAD DATA and read its warnings, both should run on the same connection
+func (c *Connection) loadData(ctx context.Context, db execQuerier, cmdtxt string) (*ImportResult, error) {
+	r, err := db.ExecContext(ctx, cmdtxt)
+	if err != nil {
+		return nil, newSQLError(err, cmdtxt)
+	}
+
+	result := new(ImportResult)
+	result.RowsLoaded, _ = r.RowsAffected()
+
+	rows, err := db.QueryContext(ctx, "show warnings")
+	if err != nil {
+		return result, fmt.Errorf("unable to read import warnings. %s", err.Error())
+	}
+	defer rows.Close()
+	for rows.Next() {
+		w := ImportWarning{}
+		if err = rows.Scan(&w.Level, &w.Code, &w.Message); err != nil {
+			return result, fmt.Errorf("unable to read import warnings. %s", err.Error())
+		}
+		result.Warnings = append(result.Warnings, w)
+	}
+	return result, rows.Err()
+}
+
+func loadDataCommand(handlerName, tableName string, opts *ImportOptions) string {
+	fieldsTerminatedBy := opts.FieldsTerminatedBy
+	if fieldsTerminatedBy == "" {
+		fieldsTerminatedBy = "\t"
+	}
+	linesTerminatedBy := opts.LinesTerminatedBy
+	if linesTerminatedBy == "" {
+		linesTerminatedBy = "\n"
+	}
+
+	cmd := fmt.Sprintf("LOAD DATA LOCAL INFILE 'Reader::%s'", handlerName)
+	if opts.Replace {
+		cmd += " REPLACE"
+	} else if opts.Ignore {
+		cmd += " IGNORE"
+	}
+	cmd += fmt.Sprintf(" INTO TABLE %s CHARACTER SET utf8mb4 FIELDS TERMINATED BY '%s' ESCAPED BY '\\\\' LINES TERMINATED BY '%s'",
+		tableName, CleanupSQL(fieldsTerminatedBy), CleanupSQL(linesTerminatedBy))
+	if opts.IgnoreLines > 0 {
+		cmd += fmt.Sprintf(" IGNORE %d LINES", opts.IgnoreLines)
+	}
+	if len(opts.Fields) > 0 {
+		cmd += " (" + strings.Join(opts.Fields, ",") + ")"
+	}
+	return cmd
+}
+
+var importEscaper = strings.NewReplacer("\\", "\\\\", "\t", "\\t", "\n", "\\n", "\r", "\\r", "\x00", "\\0")
+
+// importValue encodes v as a field of LOAD DATA default format
+func importValue(v interface{}, loc *time.Location, precision int) string {
+	v = derefValue(v)
+	switch v.(type) {
+	case nil:
+		return "\\N"
+	case string:
+		return importEscaper.Replace(v.(string))
+	case []byte:
+		return importEscaper.Replace(string(v.([]byte)))
+	case bool:
+		if v.(bool) {
+			return "1"
+		}
+		return "0"
+	case int, int8, int16, int32, int64, uint, uint8, uint16, uint32, uint64, float32, float64:
+		return fmt.Sprintf("%v", v)
+	case time.Time:
+		return formatTime(v.(time.Time), loc, precision)
+	default:
+		return importEscaper.Replace(codekit.JsonString(v))
+	}
+}
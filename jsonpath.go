@@ -0,0 +1,77 @@
+package flexmy
+
+import (
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"strings"
+
+	"git.kanosolution.net/kano/dbflex"
+)
+
+// Filter operations on JSON document recognized by flexmy
+const (
+	// OpJSONContains matches when JSON document of the field contains the value
+	OpJSONContains dbflex.FilterOp = "$jsoncontains"
+
+	// OpMemberOf matches when the value is an element of JSON array of the field, it needs MySQL 8.0.17
+	OpMemberOf dbflex.FilterOp = "$memberof"
+)
+
+// JSONContains creates filter matching documents of field, column or column->$.path, that contain value
+func JSONContains(field string, value interface{}) *dbflex.Filter {
+	return &dbflex.Filter{Field: field, Op: OpJSONContains, Value: value}
+}
+
+// MemberOf creates filter matching JSON array of field, column or column->$.path, that has value as its element
+func MemberOf(field string, value interface{}) *dbflex.Filter {
+	return &dbflex.Filter{Field: field, Op: OpMemberOf, Value: value}
+}
+
+// jsonPathField matches column->$.path field in select list and clauses of command
+var jsonPathField = regexp.MustCompile(`([A-Za-z_][A-Za-z0-9_]*)->(\$[A-Za-z0-9_.\[\]*]*)`)
+
+// splitJSONPath splits column->$.path field into its column and path
+func splitJSONPath(field string) (string, string, bool) {
+	parts := strings.SplitN(field, "->", 2)
+	if len(parts) != 2 || !strings.HasPrefix(parts[1], "$") {
+		return field, "", false
+	}
+	return strings.TrimSpace(parts[0]), strings.TrimSpace(parts[1]), true
+}
+
+// jsonFieldSQL translates column->$.path field into unquoted JSON_EXTRACT, other field is returned as is
+func jsonFieldSQL(field string) string {
+	column, path, isPath := splitJSONPath(field)
+	if !isPath {
+		return field
+	}
+	return fmt.Sprintf("JSON_UNQUOTE(JSON_EXTRACT(%s, '%s'))", column, CleanupSQL(path))
+}
+
+// rewriteJSONProjection translates JSON path fields of select command. Fields in select list are aliased
+// with their original name so fetched result could be addressed using the same name
+func rewriteJSONProjection(cmdtxt string) string {
+	if !strings.Contains(cmdtxt, "->$") {
+		return cmdtxt
+	}
+
+	selectList, rest := cmdtxt, ""
+	if idx := strings.Index(strings.ToUpper(cmdtxt), " FROM "); idx >= 0 {
+		selectList, rest = cmdtxt[:idx], cmdtxt[idx:]
+	}
+	selectList = jsonPathField.ReplaceAllStringFunc(selectList, func(field string) string {
+		return jsonFieldSQL(field) + " AS `" + field + "`"
+	})
+	rest = jsonPathField.ReplaceAllStringFunc(rest, jsonFieldSQL)
+	return selectList + rest
+}
+
+// jsonText encodes v as JSON document, string that is already a JSON document is kept as is
+func jsonText(v interface{}) string {
+	if s, ok := v.(string); ok && json.Valid([]byte(s)) {
+		return s
+	}
+	b, _ := json.Marshal(v)
+	return string(b)
+}
@@ -0,0 +1,307 @@
+package flexmy
+
+import (
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	// MigrationTable is table keeping history of applied migrations
+	MigrationTable = "flexmy_migrations"
+
+	// migrationLockPrefix is prefix of GET_LOCK name guarding migrations, the lock is server wide
+	// so the name is suffixed by the current schema
+	migrationLockPrefix = "flexmy_migrations."
+
+	// migrationLockTimeout is seconds to wait for the lock when ctx has no deadline
+	migrationLockTimeout = 60
+)
+
+// Migration is a versioned schema change. Up and Down run Go code, otherwise UpSQL and DownSQL are run,
+// they could have several statements separated by ;. MySQL commits DDL implicitly, so a migration is not atomic
+type Migration struct {
+	Version int64
+	Name    string
+
+	UpSQL   string
+	DownSQL string
+
+	Up   func(ctx context.Context, conn *Connection) error
+	Down func(ctx context.Context, conn *Connection) error
+
+	// Checksum detects a migration changed after it has been applied. For SQL migration it defaults
+	// to sha256 of UpSQL, for Go migration it defaults to sha256 of Name
+	Checksum string
+}
+
+func (m Migration) checksum() string {
+	if m.Checksum != "" {
+		return m.Checksum
+	}
+	source := m.UpSQL
+	if m.Up != nil {
+		source = m.Name
+	}
+	sum := sha256.Sum256([]byte(source))
+	return hex.EncodeToString(sum[:])
+}
+
+// AppliedMigration is a migration recorded in MigrationTable
+type AppliedMigration struct {
+	Version   int64
+	Name      string
+	Checksum  string
+	AppliedAt time.Time
+}
+
+// RegisterMigration registers migrations of the connection, version should be unique
+func (c *Connection) RegisterMigration(migrations ...Migration) error {
+	c.migrationLock.Lock()
+	defer c.migrationLock.Unlock()
+
+	for _, m := range migrations {
+		if m.Up == nil && strings.TrimSpace(m.UpSQL) == "" {
+			return fmt.Errorf("migration %d has nothing to run", m.Version)
+		}
+		for _, registered := range c.migrations {
+			if registered.Version == m.Version {
+				return fmt.Errorf("migration %d is already registered as %s", m.Version, registered.Name)
+			}
+		}
+		c.migrations = append(c.migrations, m)
+	}
+	sort.Slice(c.migrations, func(i, j int) bool {
+		return c.migrations[i].Version < c.migrations[j].Version
+	})
+	return nil
+}
+
+// Migrate applies every pending migration in order of its version and returns versions being applied
+func (c *Connection) Migrate(ctx context.Context) ([]int64, error) {
+	return c.MigrateTo(ctx, -1)
+}
+
+// MigrateTo applies pending migrations up to version, or rolls back applied migrations above version
+// when it is lower than the current one. Negative version means the latest one.
+// Migrations run under GET_LOCK advisory lock, so only one process migrates a schema at a time
+func (c *Connection) MigrateTo(ctx context.Context, version int64) ([]int64, error) {
+	c.migrationLock.Lock()
+	defer c.migrationLock.Unlock()
+
+	unlock, err := c.lockMigration(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+
+	applied, err := c.appliedMigrations(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	appliedVersions := map[int64]AppliedMigration{}
+	current := int64(0)
+	for _, am := range applied {
+		appliedVersions[am.Version] = am
+		if am.Version > current {
+			current = am.Version
+		}
+	}
+	for _, m := range c.migrations {
+		am, ok := appliedVersions[m.Version]
+		if ok && am.Checksum != m.checksum() {
+			return nil, fmt.Errorf("migration %d %s has been changed after it was applied", m.Version, m.Name)
+		}
+	}
+
+	done := []int64{}
+	if version >= 0 && version < current {
+		for idx := len(applied) - 1; idx >= 0; idx-- {
+			am := applied[idx]
+			if am.Version <= version {
+				break
+			}
+			if err = c.runMigration(ctx, am.Version, false); err != nil {
+				return done, err
+			}
+			done = append(done, am.Version)
+		}
+		return done, nil
+	}
+
+	for _, m := range c.migrations {
+		if version >= 0 && m.Version > version {
+			break
+		}
+		if _, ok := appliedVersions[m.Version]; ok {
+			continue
+		}
+		if err = c.runMigration(ctx, m.Version, true); err != nil {
+			return done, err
+		}
+		done = append(done, m.Version)
+	}
+	return done, nil
+}
+
+// RollbackTo rolls back applied migrations above version in reverse order
+func (c *Connection) RollbackTo(ctx context.Context, version int64) ([]int64, error) {
+	if version < 0 {
+		return nil, fmt.Errorf("invalid rollback version %d", version)
+	}
+	return c.MigrateTo(ctx, version)
+}
+
+// AppliedMigrations returns migrations recorded in MigrationTable ordered by version
+func (c *Connection) AppliedMigrations(ctx context.Context) ([]AppliedMigration, error) {
+	return c.appliedMigrations(ctx)
+}
+
+func (c *Connection) appliedMigrations(ctx context.Context) ([]AppliedMigration, error) {
+	cmd := "CREATE TABLE IF NOT EXISTS " + MigrationTable + " (\n" +
+		"version bigint NOT NULL,\n" +
+		"name varchar(200) NOT NULL,\n" +
+		"checksum varchar(64) NOT NULL,\n" +
+		"applied_at datetime(6) NOT NULL,\n" +
+		"PRIMARY KEY (version)\n)"
+	if _, err := c.db.ExecContext(ctx, cmd); err != nil {
+		return nil, fmt.Errorf("unable to create %s. %s", MigrationTable, err.Error())
+	}
+
+	rows, err := c.db.QueryContext(ctx, "select version, name, checksum, applied_at from "+MigrationTable+" order by version")
+	if err != nil {
+		return nil, fmt.Errorf("unable to read %s. %s", MigrationTable, err.Error())
+	}
+	defer rows.Close()
+
+	applied := []AppliedMigration{}
+	for rows.Next() {
+		am := AppliedMigration{}
+		var appliedAt interface{}
+		if err = rows.Scan(&am.Version, &am.Name, &am.Checksum, &appliedAt); err != nil {
+			return nil, fmt.Errorf("unable to read %s. %s", MigrationTable, err.Error())
+		}
+		switch appliedAt.(type) {
+		case time.Time:
+			am.AppliedAt = appliedAt.(time.Time)
+		case []byte:
+			am.AppliedAt, _ = parseDateTime(string(appliedAt.([]byte)), time.UTC)
+		}
+		applied = append(applied, am)
+	}
+	return applied, rows.Err()
+}
+
+// runMigration runs up or down of migration version and records it
+func (c *Connection) runMigration(ctx context.Context, version int64, up bool) error {
+	var m *Migration
+	for idx := range c.migrations {
+		if c.migrations[idx].Version == version {
+			m = &c.migrations[idx]
+			break
+		}
+	}
+	if m == nil {
+		return fmt.Errorf("migration %d is not registered", version)
+	}
+
+	fn, sqltext, direction := m.Up, m.UpSQL, "up"
+	if !up {
+		fn, sqltext, direction = m.Down, m.DownSQL, "down"
+		if fn == nil && strings.TrimSpace(sqltext) == "" {
+			return fmt.Errorf("migration %d %s has no down", m.Version, m.Name)
+		}
+	}
+
+	if fn != nil {
+		if err := fn(ctx, c); err != nil {
+			return fmt.Errorf("unable to run %s of migration %d %s. %w", direction, m.Version, m.Name, err)
+		}
+	} else {
+		for _, statement := range splitStatements(sqltext) {
+			if _, err := c.db.ExecContext(ctx, statement); err != nil {
+				return fmt.Errorf("unable to run %s of migration %d %s. %w", direction, m.Version, m.Name, newSQLError(err, statement))
+			}
+		}
+	}
+
+	var err error
+	if up {
+		_, err = c.db.ExecContext(ctx, "insert into "+MigrationTable+" (version, name, checksum, applied_at) values (?, ?, ?, ?)",
+			m.Version, m.Name, m.checksum(), formatTime(time.Now(), time.UTC, 6))
+	} else {
+		_, err = c.db.ExecContext(ctx, "delete from "+MigrationTable+" where version=?", m.Version)
+	}
+	if err != nil {
+		return fmt.Errorf("unable to record migration %d %s. %s", m.Version, m.Name, err.Error())
+	}
+	return nil
+}
+
+// lockMigration takes migration advisory lock on a dedicated connection, returned func releases it
+func (c *Connection) lockMigration(ctx context.Context) (func(), error) {
+	timeout := migrationLockTimeout
+	if deadline, ok := ctx.Deadline(); ok {
+		timeout = int(time.Until(deadline).Seconds())
+	}
+
+	conn, err := c.db.Conn(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	// GET_LOCK name is limited to 64 characters
+	var lockName string
+	if err = conn.QueryRowContext(ctx, "select left(concat(?, ifnull(database(), '')), 64)", migrationLockPrefix).Scan(&lockName); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("unable to acquire migration lock. %s", err.Error())
+	}
+
+	var locked sql.NullInt64
+	if err = conn.QueryRowContext(ctx, "select get_lock(?, ?)", lockName, timeout).Scan(&locked); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("unable to acquire migration lock. %s", err.Error())
+	}
+	if locked.Int64 != 1 {
+		conn.Close()
+		return nil, fmt.Errorf("unable to acquire migration lock. it is held by another process")
+	}
+
+	return func() {
+		conn.ExecContext(context.Background(), "select release_lock(?)", lockName)
+		conn.Close()
+	}, nil
+}
+
+// splitStatements splits sql text by ; outside of quotes, empty statements are skipped
+func splitStatements(text string) []string {
+	statements := []string{}
+	var quote rune
+	start := 0
+	runes := []rune(text)
+	for idx, r := range runes {
+		switch {
+		case quote != 0:
+			if r == quote && (idx == 0 || runes[idx-1] != '\\') {
+				quote = 0
+			}
+		case r == '\'' || r == '"' || r == '`':
+			quote = r
+		case r == ';':
+			if statement := strings.TrimSpace(string(runes[start:idx])); statement != "" {
+				statements = append(statements, statement)
+			}
+			start = idx + 1
+		}
+	}
+	if statement := strings.TrimSpace(string(runes[start:])); statement != "" {
+		statements = append(statements, statement)
+	}
+	return statements
+}
@@ -0,0 +1,282 @@
+package flexmy
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/go-sql-driver/mysql"
+)
+
+// OnlineMode is how EnsureTableWithOptions alters an existing table
+type OnlineMode int
+
+const (
+	// OnlineOff runs plain ALTER TABLE, server picks algorithm and lock
+	OnlineOff OnlineMode = iota
+
+	// OnlineAuto runs ALTER TABLE with ALGORITHM=INPLACE, LOCK=NONE. When server can't do the change that way
+	// the rest of the plan is run by shadow table copy
+	OnlineAuto
+
+	// OnlineShadowCopy always runs the plan by shadow table copy: the plan is applied on an empty <table>_new,
+	// rows are copied by chunk of primary key while triggers replicate ongoing writes, then both tables are
+	// swapped by an atomic RENAME TABLE. Tables having or referenced by foreign key are not supported
+	OnlineShadowCopy
+)
+
+const defaultChunkSize = 1000
+
+// inplaceUnsupported are MySQL error numbers of ALTER TABLE rejecting requested algorithm or lock
+var inplaceUnsupported = map[uint16]bool{1845: true, 1846: true}
+
+// alterOnline runs statements of plan according to opts.Online
+func (c *Connection) alterOnline(ctx context.Context, plan *TablePlan, opts *TableOptions, result *TableResult) error {
+	if opts.Online == OnlineShadowCopy {
+		return c.shadowCopy(ctx, plan, 0, opts, result)
+	}
+
+	for idx, sql := range plan.statementsOn(plan.Name, ", ALGORITHM=INPLACE, LOCK=NONE") {
+		_, err := c.db.ExecContext(ctx, sql)
+		if err != nil {
+			var myErr *mysql.MySQLError
+			if errors.As(err, &myErr) && inplaceUnsupported[myErr.Number] {
+				return c.shadowCopy(ctx, plan, idx, opts, result)
+			}
+			return fmt.Errorf("unable to alter table %s. %s", plan.Name, err.Error())
+		}
+		result.Commands = append(result.Commands, sql)
+	}
+	return nil
+}
+
+// shadowCopy runs statements of plan starting at index from on a copy of the table and swaps them
+func (c *Connection) shadowCopy(ctx context.Context, plan *TablePlan, from int, opts *TableOptions, result *TableResult) error {
+	name := plan.Name
+	newName, oldName := name+"_new", name+"_old"
+
+	if err := c.checkShadowCopy(ctx, name, newName, oldName); err != nil {
+		return err
+	}
+	pk, err := c.primaryKey(ctx, name)
+	if err != nil {
+		return err
+	}
+	if len(pk) == 0 {
+		return fmt.Errorf("unable to copy table %s online. it has no primary key", name)
+	}
+
+	run := func(cmd string) error {
+		if _, err := c.db.ExecContext(ctx, cmd); err != nil {
+			return newSQLError(err, cmd)
+		}
+		result.Commands = append(result.Commands, cmd)
+		return nil
+	}
+
+	triggers := []string{name + "_osc_ins", name + "_osc_upd", name + "_osc_del"}
+	cleanup := func() {
+		for _, trigger := range triggers {
+			c.db.ExecContext(context.Background(), "drop trigger if exists "+trigger)
+		}
+		c.db.ExecContext(context.Background(), "drop table if exists "+newName)
+	}
+
+	if err = run(fmt.Sprintf("create table %s like %s", newName, name)); err != nil {
+		return fmt.Errorf("unable to copy table %s online. %s", name, err.Error())
+	}
+	for _, cmd := range plan.statementsOn(newName, "")[from:] {
+		if err = run(cmd); err != nil {
+			cleanup()
+			return fmt.Errorf("unable to copy table %s online. %s", name, err.Error())
+		}
+	}
+
+	columns, sources, err := c.shadowColumns(ctx, plan, newName)
+	if err != nil {
+		cleanup()
+		return err
+	}
+	pkColumns := make([]string, len(pk))
+	pkSources := make([]string, len(pk))
+	for idx, column := range pk {
+		pkSources[idx] = column
+		pkColumns[idx] = column
+		for newColumn, oldColumn := range plan.renames {
+			if strings.EqualFold(oldColumn, column) {
+				pkColumns[idx] = newColumn
+			}
+		}
+	}
+
+	for _, cmd := range shadowTriggers(name, newName, triggers, columns, sources, pkColumns, pkSources) {
+		if err = run(cmd); err != nil {
+			cleanup()
+			return fmt.Errorf("unable to copy table %s online. %s", name, err.Error())
+		}
+	}
+
+	if err = c.copyChunks(ctx, name, newName, columns, sources, pkSources, opts.ChunkSize); err != nil {
+		cleanup()
+		return fmt.Errorf("unable to copy table %s online. %s", name, err.Error())
+	}
+
+	if err = run(fmt.Sprintf("rename table %s to %s, %s to %s", name, oldName, newName, name)); err != nil {
+		cleanup()
+		return fmt.Errorf("unable to swap table %s. %s", name, err.Error())
+	}
+	// triggers belong to the old table and are dropped along with it
+	if err = run("drop table " + oldName); err != nil {
+		return fmt.Errorf("table %s has been changed but %s could not be dropped. %s", name, oldName, err.Error())
+	}
+	return nil
+}
+
+// checkShadowCopy check if table could be copied online
+func (c *Connection) checkShadowCopy(ctx context.Context, name, newName, oldName string) error {
+	for _, tableName := range []string{newName, oldName} {
+		exists, err := c.tableExists(ctx, tableName)
+		if err != nil {
+			return err
+		}
+		if exists {
+			return fmt.Errorf("unable to copy table %s online. table %s already exists", name, tableName)
+		}
+	}
+
+	cmd := "select count(*) from information_schema.REFERENTIAL_CONSTRAINTS " +
+		"where constraint_schema=database() and (lower(table_name)=? or lower(referenced_table_name)=?)"
+	references := 0
+	if err := c.db.QueryRowContext(ctx, cmd, strings.ToLower(name), strings.ToLower(name)).Scan(&references); err != nil {
+		return fmt.Errorf("unable to read foreign keys of %s. %s", name, err.Error())
+	}
+	if references > 0 {
+		return fmt.Errorf("unable to copy table %s online. it has or is referenced by foreign key", name)
+	}
+	return nil
+}
+
+// primaryKey returns columns of primary key of table
+func (c *Connection) primaryKey(ctx context.Context, name string) ([]string, error) {
+	cmd := "select column_name from information_schema.STATISTICS " +
+		"where table_schema=database() and lower(table_name)=? and index_name='PRIMARY' order by seq_in_index"
+	rows, err := c.db.QueryContext(ctx, cmd, strings.ToLower(name))
+	if err != nil {
+		return nil, fmt.Errorf("unable to read primary key of %s. %s", name, err.Error())
+	}
+	defer rows.Close()
+
+	columns := []string{}
+	for rows.Next() {
+		column := ""
+		if err = rows.Scan(&column); err != nil {
+			return nil, fmt.Errorf("unable to read primary key of %s. %s", name, err.Error())
+		}
+		columns = append(columns, column)
+	}
+	return columns, rows.Err()
+}
+
+// shadowColumns returns columns of the new table to be copied and their source columns of the old table.
+// Columns added by the plan are left to their default
+func (c *Connection) shadowColumns(ctx context.Context, plan *TablePlan, newName string) ([]string, []string, error) {
+	oldColumns, err := c.existingColumns(ctx, plan.Name)
+	if err != nil {
+		return nil, nil, err
+	}
+	newColumns, err := c.existingColumns(ctx, newName)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	oldNames := map[string]string{}
+	for _, col := range oldColumns {
+		oldNames[strings.ToLower(col.Name)] = col.Name
+	}
+
+	columns, sources := []string{}, []string{}
+	for _, col := range newColumns {
+		// renamed column has its old name, unless it has been renamed in place before falling back to copy
+		oldName, ok := oldNames[strings.ToLower(plan.renames[col.Name])]
+		if !ok {
+			oldName, ok = oldNames[strings.ToLower(col.Name)]
+		}
+		if !ok {
+			continue
+		}
+		columns = append(columns, col.Name)
+		sources = append(sources, oldName)
+	}
+	return columns, sources, nil
+}
+
+// shadowTriggers returns triggers replicating writes of table into the new table while rows are copied
+func shadowTriggers(name, newName string, triggers, columns, sources, pkColumns, pkSources []string) []string {
+	prefixed := func(prefix string, names []string) string {
+		out := make([]string, len(names))
+		for idx, n := range names {
+			out[idx] = prefix + n
+		}
+		return strings.Join(out, ",")
+	}
+
+	replace := fmt.Sprintf("REPLACE INTO %s (%s) VALUES (%s)", newName, strings.Join(columns, ","), prefixed("NEW.", sources))
+	deleteOld := fmt.Sprintf("DELETE IGNORE FROM %s WHERE (%s) = (%s)", newName, strings.Join(pkColumns, ","), prefixed("OLD.", pkSources))
+	return []string{
+		fmt.Sprintf("CREATE TRIGGER %s AFTER INSERT ON %s FOR EACH ROW %s", triggers[0], name, replace),
+		fmt.Sprintf("CREATE TRIGGER %s AFTER UPDATE ON %s FOR EACH ROW BEGIN %s; %s; END", triggers[1], name, deleteOld, replace),
+		fmt.Sprintf("CREATE TRIGGER %s AFTER DELETE ON %s FOR EACH ROW %s", triggers[2], name, deleteOld),
+	}
+}
+
+// copyChunks copies rows of table into newName by chunk of primary key. Rows already written by the triggers are kept
+func (c *Connection) copyChunks(ctx context.Context, name, newName string, columns, sources, pk []string, chunkSize int) error {
+	if chunkSize <= 0 {
+		chunkSize = defaultChunkSize
+	}
+	pkList := strings.Join(pk, ",")
+	marks := strings.TrimSuffix(strings.Repeat("?,", len(pk)), ",")
+	copyCmd := fmt.Sprintf("INSERT IGNORE INTO %s (%s) SELECT %s FROM %s", newName, strings.Join(columns, ","), strings.Join(sources, ","), name)
+
+	var last []interface{}
+	for {
+		where, args := "", []interface{}{}
+		if last != nil {
+			where = fmt.Sprintf(" WHERE (%s) > (%s)", pkList, marks)
+			args = append(args, last...)
+		}
+
+		// upper bound of the chunk, none means the chunk is the last one
+		upper := make([]interface{}, len(pk))
+		ptrs := make([]interface{}, len(pk))
+		for idx := range upper {
+			ptrs[idx] = &upper[idx]
+		}
+		boundCmd := fmt.Sprintf("SELECT %s FROM %s%s ORDER BY %s LIMIT 1 OFFSET %d", pkList, name, where, pkList, chunkSize-1)
+		err := c.db.QueryRowContext(ctx, boundCmd, args...).Scan(ptrs...)
+		if err == sql.ErrNoRows {
+			cmd := copyCmd + where + " LOCK IN SHARE MODE"
+			if _, err = c.db.ExecContext(ctx, cmd, args...); err != nil {
+				return newSQLError(err, cmd)
+			}
+			return nil
+		}
+		if err != nil {
+			return newSQLError(err, boundCmd)
+		}
+
+		cmd := copyCmd
+		if last != nil {
+			cmd += where + fmt.Sprintf(" AND (%s) <= (%s)", pkList, marks)
+		} else {
+			cmd += fmt.Sprintf(" WHERE (%s) <= (%s)", pkList, marks)
+		}
+		cmd += " LOCK IN SHARE MODE"
+		if _, err = c.db.ExecContext(ctx, cmd, append(args, upper...)...); err != nil {
+			return newSQLError(err, cmd)
+		}
+		last = upper
+	}
+}
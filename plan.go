@@ -0,0 +1,197 @@
+package flexmy
+
+import (
+	"context"
+	"fmt"
+	"strings"
+)
+
+// ChangeKind classifies a schema change by its risk
+type ChangeKind string
+
+const (
+	// ChangeSafe is creating table, adding column, index or constraint and widening a column
+	ChangeSafe ChangeKind = "safe"
+
+	// ChangeLossy is column change that could truncate or reject existing data, ie narrowing its type
+	ChangeLossy ChangeKind = "lossy"
+
+	// ChangeIndexRebuild is dropping or re-creating an index or a foreign key
+	ChangeIndexRebuild ChangeKind = "index_rebuild"
+)
+
+// SchemaChange is a DDL change of a table
+type SchemaChange struct {
+	Kind ChangeKind
+
+	// SQL is the change as a standalone statement
+	SQL string
+
+	// Detail describes the change, ie old and new type of a column
+	Detail string
+
+	// clause is alter specification of the change, changes are combined into as few statements as possible
+	clause string
+
+	// first changes are run in a statement ahead of the others, ie foreign key must be dropped before it is added again
+	first bool
+}
+
+// TablePlan is list of changes needed to make a table match its struct
+type TablePlan struct {
+	Name             string
+	Create           bool
+	Changes          []SchemaChange
+	StaleIndexes     []string
+	StaleForeignKeys []string
+	StaleColumns     []string
+
+	// renames maps renamed column into its old name
+	renames map[string]string
+}
+
+// Lossy returns lossy changes of the plan
+func (p *TablePlan) Lossy() []SchemaChange {
+	changes := []SchemaChange{}
+	for _, change := range p.Changes {
+		if change.Kind == ChangeLossy {
+			changes = append(changes, change)
+		}
+	}
+	return changes
+}
+
+// Statements returns DDL statements of the plan in order they are run
+func (p *TablePlan) Statements() []string {
+	return p.statementsOn(p.Name, "")
+}
+
+// statementsOn returns alter statements of the plan applied on table, suffix is appended into every statement
+func (p *TablePlan) statementsOn(table, suffix string) []string {
+	if p.Create {
+		statements := []string{}
+		for _, change := range p.Changes {
+			statements = append(statements, change.SQL)
+		}
+		return statements
+	}
+
+	firsts, others := []string{}, []string{}
+	for _, change := range p.Changes {
+		if change.first {
+			firsts = append(firsts, change.clause)
+		} else {
+			others = append(others, change.clause)
+		}
+	}
+
+	statements := []string{}
+	for _, clauses := range [][]string{firsts, others} {
+		if len(clauses) > 0 {
+			statements = append(statements, fmt.Sprintf("alter table %s ", table)+strings.Join(clauses, ", ")+suffix)
+		}
+	}
+	return statements
+}
+
+func (p *TablePlan) addChange(kind ChangeKind, clause, detail string, first bool) {
+	p.Changes = append(p.Changes, SchemaChange{
+		Kind:   kind,
+		SQL:    fmt.Sprintf("alter table %s %s", p.Name, clause),
+		Detail: detail,
+		clause: clause,
+		first:  first,
+	})
+}
+
+// PlanTable returns changes EnsureTable would run on table, without running them
+func (c *Connection) PlanTable(name string, keys []string, obj interface{}) (*TablePlan, error) {
+	return c.PlanTableWithOptions(context.Background(), name, keys, obj, nil)
+}
+
+// PlanTableWithOptions returns changes EnsureTableWithOptions would run on table, without running them
+func (c *Connection) PlanTableWithOptions(ctx context.Context, name string, keys []string, obj interface{}, opts *TableOptions) (*TablePlan, error) {
+	if opts == nil {
+		opts = new(TableOptions)
+	}
+	spec := newTableSpec(name, keys, obj, opts, c)
+
+	tableExists, err := c.tableExists(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+
+	if !tableExists {
+		plan := &TablePlan{Name: name, Create: true}
+		plan.Changes = []SchemaChange{{Kind: ChangeSafe, SQL: createCommandForCreate(spec), Detail: "create table"}}
+		return plan, nil
+	}
+	return createCommandForUpdate(ctx, spec, opts, c)
+}
+
+// lossyError returns error of refusing lossy changes of plan
+func lossyError(plan *TablePlan) error {
+	details, statements := []string{}, []string{}
+	for _, change := range plan.Lossy() {
+		details = append(details, change.Detail)
+		statements = append(statements, change.SQL)
+	}
+	return &Error{
+		Kind: ErrLossyChange,
+		SQL:  strings.Join(statements, "; "),
+		Err:  fmt.Errorf("table %s has lossy changes: %s", plan.Name, strings.Join(details, ", ")),
+	}
+}
+
+var integerRanks = map[string]int{"tinyint": 1, "smallint": 2, "mediumint": 3, "int": 4, "integer": 4, "bigint": 5}
+
+// textSizes are maximum bytes of text types
+var textSizes = map[string]int64{"tinytext": 255, "text": 65535, "mediumtext": 16777215, "longtext": 4294967295}
+
+// isWidening check if changing column type from old into new keeps every existing value
+func isWidening(old, new string) bool {
+	o, n := parseColumnType(old), parseColumnType(new)
+
+	if oRank, ok := integerRanks[o.Name]; ok {
+		nRank, ok := integerRanks[n.Name]
+		if !ok {
+			return n.Name == "decimal" && n.arg(0, 10)-n.arg(1, 0) >= 20
+		}
+		if o.Unsigned == n.Unsigned {
+			return nRank >= oRank
+		}
+		return o.Unsigned && nRank > oRank
+	}
+
+	switch o.Name {
+	case "char", "varchar":
+		length := o.arg(0, 1)
+		if n.Name == "char" || n.Name == "varchar" {
+			return n.arg(0, 1) >= length
+		}
+		// a character takes up to 4 bytes in utf8mb4
+		size, ok := textSizes[n.Name]
+		return ok && size >= int64(length)*4
+
+	case "tinytext", "text", "mediumtext", "longtext":
+		size, ok := textSizes[n.Name]
+		return ok && size >= textSizes[o.Name]
+
+	case "decimal":
+		precision, scale := o.arg(0, 10), o.arg(1, 0)
+		return n.Name == "decimal" && n.arg(1, 0) >= scale && n.arg(0, 10)-n.arg(1, 0) >= precision-scale
+
+	case "float":
+		return n.Name == "float" || n.Name == "double"
+
+	case "double":
+		return n.Name == "double"
+
+	case "date":
+		return n.Name == "date" || n.Name == "datetime"
+
+	case "datetime", "timestamp", "time":
+		return n.Name == o.Name && n.arg(0, 0) >= o.arg(0, 0)
+	}
+	return false
+}
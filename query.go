@@ -1,9 +1,14 @@
 package flexmy
 
 import (
+	"context"
 	"database/sql"
+	"database/sql/driver"
 	"errors"
 	"fmt"
+	"math/big"
+	"reflect"
+	"strconv"
 	"strings"
 	"time"
 
@@ -15,9 +20,30 @@ import (
 // Query implementaion of dbflex.IQuery
 type Query struct {
 	rdbms.Query
-	db         *sql.DB
-	tx         *sql.Tx
-	sqlcommand string
+	db            *sql.DB
+	tx            *sql.Tx
+	txConnID      int64
+	ctx           context.Context
+	sqlcommand    string
+	literalSQL    bool
+	guessType     bool
+	storeLoc      *time.Location
+	timePrecision int
+	filterArgs    []interface{}
+}
+
+// SetContext set context used by query to run its command. When ctx is cancelled,
+// running command will be killed on the server
+func (q *Query) SetContext(ctx context.Context) {
+	q.ctx = ctx
+}
+
+// Context returns context of the query
+func (q *Query) Context() context.Context {
+	if q.ctx == nil {
+		return context.Background()
+	}
+	return q.ctx
 }
 
 // Cursor produces a cursor from query
@@ -36,6 +62,16 @@ func (q *Query) Cursor(in codekit.M) dbflex.ICursor {
 		cursor.SetError(fmt.Errorf("no command"))
 		return cursor
 	}
+	cmdtxt = rewriteJSONProjection(cmdtxt)
+
+	if lock := q.Config(ConfigLock, in[ConfigLock]); lock != nil && lock != "" {
+		lockClause, err := q.lockClause(ct, lock)
+		if err != nil {
+			cursor.SetError(err)
+			return cursor
+		}
+		cmdtxt = cmdtxt + " " + lockClause
+	}
 
 	tablename := q.Config(dbflex.ConfigKeyTableName, "").(string)
 	cq := dbflex.From(tablename).Select("count(*) as Count")
@@ -44,18 +80,13 @@ func (q *Query) Cursor(in codekit.M) dbflex.ICursor {
 	}
 	cursor.SetCountCommand(cq)
 
-	var rows *sql.Rows
-	var err error
-
-	if q.tx == nil {
-		rows, err = q.db.Query(cmdtxt)
-	} else {
-		rows, err = q.tx.Query(cmdtxt)
-	}
+	rows, err := q.query(cmdtxt, q.filterArgs)
 	if rows == nil {
-		cursor.SetError(fmt.Errorf("%s. SQL Command: %s", err.Error(), cmdtxt))
+		cursor.SetError(newSQLError(err, cmdtxt))
 	} else {
-		cursor.SetFetcher(rows)
+		cursor.guessType = q.guessType
+		cursor.loc = q.storeLoc
+		cursor.setRows(rows)
 	}
 	return cursor
 }
@@ -73,6 +104,7 @@ func (q *Query) Execute(in codekit.M) (interface{}, error) {
 
 	var (
 		sqlfieldnames []string
+		values        []interface{}
 		sqlvalues     []string
 	)
 
@@ -81,25 +113,25 @@ func (q *Query) Execute(in codekit.M) (interface{}, error) {
 		return nil, errors.New("non select and delete command should has data")
 	}
 
+	if hasData && cmdtype == dbflex.QueryInsert && isBulkData(data) {
+		return q.bulkInsert(data)
+	}
+
+	var (
+		allfieldnames []string
+		allvalues     []interface{}
+		allsqlvalues  []string
+	)
+
 	if hasData {
-		sqlfieldnames, _, _, sqlvalues = rdbms.ParseSQLMetadata(q, data)
-		affectedfields := q.Config("fields", []string{}).([]string)
-		if len(affectedfields) > 0 {
-			newfieldnames := []string{}
-			newvalues := []string{}
-			for idx, field := range sqlfieldnames {
-				for _, find := range affectedfields {
-					if strings.ToLower(field) == strings.ToLower(find) {
-						newfieldnames = append(newfieldnames, find)
-						newvalues = append(newvalues, sqlvalues[idx])
-					}
-				}
-			}
-			sqlfieldnames = newfieldnames
-			sqlvalues = newvalues
-		}
+		sqlfieldnames, values, sqlvalues = q.parseData(data)
+		allfieldnames, allvalues, allsqlvalues = sqlfieldnames, values, sqlvalues
+
+		sqlfieldnames, values, sqlvalues = q.affectedFields(sqlfieldnames, values, sqlvalues)
 	}
 
+	args := []interface{}{}
+
 	switch cmdtype {
 	case dbflex.QuerySave:
 		tableName := q.Config(dbflex.ConfigKeyTableName, "").(string)
@@ -108,10 +140,27 @@ func (q *Query) Execute(in codekit.M) (interface{}, error) {
 			return nil, fmt.Errorf("save operations should have filter")
 		}
 
+		conn, isMy := q.Connection().(*Connection)
+		if isMy {
+			keys, err := conn.uniqueKeys(q.Context(), tableName)
+			if err != nil {
+				return nil, fmt.Errorf("unable to get unique keys of %s. %w", tableName, err)
+			}
+			if keyCovers(keys, equalityFields(filter.(*dbflex.Filter))) {
+				return q.upsert(tableName, allfieldnames, allvalues, allsqlvalues, sqlfieldnames)
+			}
+		}
+
+		// no unique key covering the filter, check existing data before decide insert or update
 		cmdGets := dbflex.From(tableName).Where(filter.(*dbflex.Filter)).Select()
-		cursor := q.Connection().Cursor(cmdGets, nil)
+		var cursor dbflex.ICursor
+		if isMy {
+			cursor = conn.CursorContext(q.Context(), cmdGets, nil)
+		} else {
+			cursor = q.Connection().Cursor(cmdGets, nil)
+		}
 		if err := cursor.Error(); err != nil {
-			return nil, fmt.Errorf("unable to get data for checking. %s", err.Error())
+			return nil, fmt.Errorf("unable to get data for checking. %w", err)
 		}
 
 		//fmt.Println("Filter:", codekit.JsonString(filter))
@@ -123,12 +172,18 @@ func (q *Query) Execute(in codekit.M) (interface{}, error) {
 		}
 		cursor.Close()
 
+		if isMy {
+			return conn.ExecuteContext(q.Context(), saveCmd, in)
+		}
 		return q.Connection().Execute(saveCmd, in)
 
 	case dbflex.QueryInsert:
 		cmdtxt = strings.Replace(cmdtxt, "{{.FIELDS}}", strings.Join(sqlfieldnames, ","), -1)
 		cmdtxt = strings.Replace(cmdtxt, "{{.VALUES}}", strings.Join(sqlvalues, ","), -1)
 		//fmt.Printfn("\nCmd: %s", cmdtxt)
+		if !q.literalSQL {
+			args = append(args, values...)
+		}
 
 	case dbflex.QueryUpdate:
 		//fmt.Println("fieldnames:", sqlfieldnames)
@@ -137,23 +192,173 @@ func (q *Query) Execute(in codekit.M) (interface{}, error) {
 			updatedfields = append(updatedfields, fieldname+"="+sqlvalues[idx])
 		}
 		cmdtxt = strings.Replace(cmdtxt, "{{.FIELDVALUES}}", strings.Join(updatedfields, ","), -1)
+		if !q.literalSQL {
+			args = append(args, values...)
+		}
+	}
+
+	if !q.literalSQL {
+		args = append(args, q.filterArgs...)
 	}
 
 	//fmt.Println("Cmd: ", cmdtxt)
-	var r sql.Result
-	var err error
+	r, err := q.exec(cmdtxt, args)
+	if err != nil {
+		return nil, newSQLError(err, cmdtxt)
+	}
+	return r, nil
+}
+
+// lockClause validates lock and returns its clause, lock is only valid for select command inside transaction
+func (q *Query) lockClause(cmdtype string, lock interface{}) (string, error) {
+	var mode LockMode
+	switch lock.(type) {
+	case LockMode:
+		mode = lock.(LockMode)
+	case string:
+		mode = LockMode(strings.ToUpper(lock.(string)))
+	default:
+		return "", fmt.Errorf("invalid lock %v", lock)
+	}
+
+	valid := false
+	for _, m := range lockModes {
+		if m == mode {
+			valid = true
+			break
+		}
+	}
+	if !valid {
+		return "", fmt.Errorf("invalid lock %s", mode)
+	}
+	if cmdtype != dbflex.QuerySelect {
+		return "", fmt.Errorf("lock %s is only valid for select command", mode)
+	}
 	if q.tx == nil {
-		r, err = q.db.Exec(cmdtxt)
-	} else {
-		r, err = q.tx.Exec(cmdtxt)
+		return "", fmt.Errorf("lock %s should be used inside transaction, call BeginTx first", mode)
+	}
+	return string(mode), nil
+}
+
+// parseData returns field names and values of data. Values are converted to database/sql arguments
+// and sql values are ? placeholders unless query is in literal SQL mode
+func (q *Query) parseData(data interface{}) ([]string, []interface{}, []string) {
+	fieldnames, _, values, sqlvalues := rdbms.ParseSQLMetadata(q, data)
+	if !q.literalSQL {
+		for idx, v := range values {
+			values[idx] = q.valueToArg(v)
+			sqlvalues[idx] = "?"
+		}
+	}
+	return fieldnames, values, sqlvalues
+}
+
+// affectedFields narrows fields and their values into fields defined in query config, if any
+func (q *Query) affectedFields(fieldnames []string, values []interface{}, sqlvalues []string) ([]string, []interface{}, []string) {
+	affectedfields := q.Config("fields", []string{}).([]string)
+	if len(affectedfields) == 0 {
+		return fieldnames, values, sqlvalues
+	}
+
+	newfieldnames := []string{}
+	newvalues := []interface{}{}
+	newsqlvalues := []string{}
+	for idx, field := range fieldnames {
+		for _, find := range affectedfields {
+			if strings.ToLower(field) == strings.ToLower(find) {
+				newfieldnames = append(newfieldnames, find)
+				newvalues = append(newvalues, values[idx])
+				newsqlvalues = append(newsqlvalues, sqlvalues[idx])
+			}
+		}
+	}
+	return newfieldnames, newvalues, newsqlvalues
+}
+
+// upsert saves data using single INSERT ... ON DUPLICATE KEY UPDATE command, only updatefields are updated
+// when the row already exists
+func (q *Query) upsert(tableName string, fieldnames []string, values []interface{}, sqlvalues []string, updatefields []string) (interface{}, error) {
+	if len(fieldnames) == 0 {
+		return nil, fmt.Errorf("save operations should have at least one field")
+	}
+	updates := []string{}
+	for _, field := range updatefields {
+		updates = append(updates, fmt.Sprintf("%s=VALUES(%s)", field, field))
+	}
+	if len(updates) == 0 {
+		updates = append(updates, fmt.Sprintf("%s=%s", fieldnames[0], fieldnames[0]))
+	}
+
+	cmdtxt := fmt.Sprintf("INSERT INTO %s (%s) VALUES (%s) ON DUPLICATE KEY UPDATE %s",
+		tableName, strings.Join(fieldnames, ","), strings.Join(sqlvalues, ","), strings.Join(updates, ","))
+	args := []interface{}{}
+	if !q.literalSQL {
+		args = values
 	}
 
+	r, err := q.exec(cmdtxt, args)
 	if err != nil {
-		return nil, fmt.Errorf("%s. SQL Command: %s", err.Error(), cmdtxt)
+		return nil, newSQLError(err, cmdtxt)
 	}
 	return r, nil
 }
 
+// query runs cmdtxt using context of the query. For cancellable context outside of transaction, command is run
+// on a dedicated connection so it can be killed, the connection is returned to pool once rows are closed.
+// The query is killed while it is executed, cancelling ctx while rows are fetched closes them instead
+func (q *Query) query(cmdtxt string, args []interface{}) (*sql.Rows, error) {
+	ctx := q.Context()
+	if q.tx != nil {
+		stop := watchKill(ctx, q.db, q.txConnID)
+		rows, err := q.tx.QueryContext(ctx, cmdtxt, args...)
+		stop()
+		return rows, err
+	}
+
+	if ctx.Done() == nil {
+		return q.db.QueryContext(ctx, cmdtxt, args...)
+	}
+
+	conn, connID, err := dedicatedConn(ctx, q.db)
+	if err != nil {
+		return nil, err
+	}
+	stop := watchKill(ctx, q.db, connID)
+	rows, err := conn.QueryContext(ctx, cmdtxt, args...)
+	stop()
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	// Close blocks until rows are closed
+	go conn.Close()
+	return rows, nil
+}
+
+// exec runs non select cmdtxt using context of the query
+func (q *Query) exec(cmdtxt string, args []interface{}) (sql.Result, error) {
+	ctx := q.Context()
+	if q.tx != nil {
+		stop := watchKill(ctx, q.db, q.txConnID)
+		defer stop()
+		return q.tx.ExecContext(ctx, cmdtxt, args...)
+	}
+
+	if ctx.Done() == nil {
+		return q.db.ExecContext(ctx, cmdtxt, args...)
+	}
+
+	conn, connID, err := dedicatedConn(ctx, q.db)
+	if err != nil {
+		return nil, err
+	}
+	stop := watchKill(ctx, q.db, connID)
+	r, err := conn.ExecContext(ctx, cmdtxt, args...)
+	stop()
+	conn.Close()
+	return r, err
+}
+
 // ExecType to identify type of exec
 type ExecType int
 
@@ -170,28 +375,88 @@ func (q *Query) SQL(string cmd, exec) dbflex.IQuery {
 */
 
 func (q *Query) ValueToSQlValue(v interface{}) string {
+	v = derefValue(v)
 	switch v.(type) {
+	case nil:
+		return "NULL"
 	case int, int8, int16, int32, int64:
 		return fmt.Sprintf("%d", v)
-	case float32, float64:
-		return fmt.Sprintf("%f", v)
+	case float32:
+		return strconv.FormatFloat(float64(v.(float32)), 'f', -1, 32)
+	case float64:
+		return strconv.FormatFloat(v.(float64), 'f', -1, 64)
 	case time.Time:
-		return codekit.Date2String(v.(time.Time), "'yyyy-MM-dd HH:mm:ss'")
-	case *time.Time:
-		dt := v.(*time.Time)
-		return codekit.Date2String(*dt, "'yyyy-MM-dd HH:mm:ss'")
+		return "'" + formatTime(v.(time.Time), q.storeLoc, q.timePrecision) + "'"
 	case bool:
 		if v.(bool) {
 			return "true"
 		}
 		return "false"
 	case string:
-		return fmt.Sprintf("'%s'", v.(string))
+		return fmt.Sprintf("'%s'", CleanupSQL(v.(string)))
 	default:
 		return fmt.Sprintf("'%s'", CleanupSQL(fmt.Sprintf("%v", codekit.JsonString(v))))
 	}
 }
 
+// valueToArg converts v into value that can be passed as argument of database/sql
+func (q *Query) valueToArg(v interface{}) interface{} {
+	v = derefValue(v)
+	switch v.(type) {
+	case nil, int, int8, int16, int32, int64, uint, uint8, uint16, uint32, uint64,
+		float32, float64, bool, string, []byte:
+		return v
+	case time.Time:
+		return formatTime(v.(time.Time), q.storeLoc, q.timePrecision)
+	default:
+		return codekit.JsonString(v)
+	}
+}
+
+// derefValue resolves pointer and driver.Valuer into their underlying value, nil pointer and invalid
+// sql.Null* are resolved as nil so they are written as NULL
+func derefValue(v interface{}) interface{} {
+	switch v.(type) {
+	case *big.Rat:
+		if r := v.(*big.Rat); r != nil {
+			return ratString(r)
+		}
+		return nil
+	case big.Rat:
+		r := v.(big.Rat)
+		return ratString(&r)
+	}
+
+	if valuer, ok := v.(driver.Valuer); ok {
+		rv := reflect.ValueOf(v)
+		if rv.Kind() == reflect.Ptr && rv.IsNil() {
+			return nil
+		}
+		dv, err := valuer.Value()
+		if err != nil {
+			return v
+		}
+		return dv
+	}
+
+	rv := reflect.ValueOf(v)
+	for rv.Kind() == reflect.Ptr {
+		if rv.IsNil() {
+			return nil
+		}
+		rv = rv.Elem()
+	}
+	if !rv.IsValid() {
+		return nil
+	}
+	if (rv.Kind() == reflect.Map || rv.Kind() == reflect.Slice) && rv.IsNil() {
+		return nil
+	}
+	return rv.Interface()
+}
+
+// CleanupSQL escapes quote and backslash of s so it can be written as MySQL string literal
 func CleanupSQL(s string) string {
+	s = strings.Replace(s, "\\", "\\\\", -1)
 	return strings.Replace(s, "'", "''", -1)
 }
@@ -0,0 +1,99 @@
+package flexmy
+
+import (
+	"context"
+	"errors"
+	"math/rand"
+	"time"
+
+	"git.kanosolution.net/kano/dbflex"
+)
+
+// NoRetry is MaxRetry of RunInTxOptions that runs transaction only once
+const NoRetry = -1
+
+// RunInTxOptions is option of RunInTx
+type RunInTxOptions struct {
+	// Tx is option used to begin each attempt
+	Tx *TxOptions
+
+	// MaxRetry is maximum number of retry after the first attempt, 0 means default of 3.
+	// Negative value, ie NoRetry, turns retry off
+	MaxRetry int
+
+	// BackoffBase is wait time before the first retry, it is doubled on each next retry. Default is 50ms
+	BackoffBase time.Duration
+
+	// BackoffMax caps wait time between retries, default is 2s
+	BackoffMax time.Duration
+}
+
+// RunInTx runs fn inside a transaction. Transaction is committed when fn returns nil, otherwise it is rolled back.
+// When fn or commit fails because of deadlock or lock wait timeout, whole transaction is retried with jittered backoff
+func (c *Connection) RunInTx(fn func(conn dbflex.IConnection) error, opts *RunInTxOptions) error {
+	return c.RunInTxContext(context.Background(), fn, opts)
+}
+
+// RunInTxContext is RunInTx bound to ctx, no retry will be made once ctx is done.
+// When connection is already in transaction, fn runs in a nested level and is never retried,
+// since MySQL rolls back the whole transaction on deadlock, retry is left to the outermost level
+func (c *Connection) RunInTxContext(ctx context.Context, fn func(conn dbflex.IConnection) error, opts *RunInTxOptions) error {
+	if opts == nil {
+		opts = new(RunInTxOptions)
+	}
+	maxRetry := opts.MaxRetry
+	if maxRetry == 0 {
+		maxRetry = 3
+	} else if maxRetry < 0 {
+		maxRetry = 0
+	}
+	backoffBase := opts.BackoffBase
+	if backoffBase == 0 {
+		backoffBase = 50 * time.Millisecond
+	}
+	backoffMax := opts.BackoffMax
+	if backoffMax == 0 {
+		backoffMax = 2 * time.Second
+	}
+
+	if c.IsTx() {
+		return c.runTxOnce(ctx, fn, nil)
+	}
+
+	for attempt := 0; ; attempt++ {
+		err := c.runTxOnce(ctx, fn, opts.Tx)
+		if err == nil || !isRetryableTxError(err) || attempt >= maxRetry {
+			return err
+		}
+
+		wait := backoffBase << uint(attempt)
+		if wait > backoffMax || wait <= 0 {
+			wait = backoffMax
+		}
+		wait = wait/2 + time.Duration(rand.Int63n(int64(wait/2)+1))
+		select {
+		case <-ctx.Done():
+			return err
+		case <-time.After(wait):
+		}
+	}
+}
+
+func (c *Connection) runTxOnce(ctx context.Context, fn func(conn dbflex.IConnection) error, opts *TxOptions) error {
+	if err := c.BeginTxWithOptions(ctx, opts); err != nil {
+		return err
+	}
+	if err := fn(c); err != nil {
+		c.RollBack()
+		return err
+	}
+	return c.Commit()
+}
+
+// isRetryableTxError check if err is deadlock or lock wait timeout, either as *Error or as bare *mysql.MySQLError
+func isRetryableTxError(err error) bool {
+	if kind := ErrorKind(err); kind == ErrDeadlock || kind == ErrLockWaitTimeout {
+		return true
+	}
+	return errors.Is(err, ErrDeadlock) || errors.Is(err, ErrLockWaitTimeout)
+}
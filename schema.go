@@ -0,0 +1,384 @@
+package flexmy
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+
+	"github.com/sebarcode/codekit"
+)
+
+// TagName is struct tag defining column of EnsureTable. Options are separated by ; ie
+// `flexmy:"type=varchar(64);notnull;default=now();index;unique;autoinc;comment=customer name;charset=utf8mb4;collate=utf8mb4_bin"`
+//
+// was=OldName renames existing OldName column into the field instead of adding a new column
+//
+// index, unique and fulltext could be given a name, fields sharing the same name build a composite index
+// in order of the fields, ie `flexmy:"index=ix_group_date"`. length=N indexes only N first characters
+const TagName = "flexmy"
+
+// Index is secondary index of a table
+type Index struct {
+	Name string
+
+	// Columns of the index, prefix length is written as column(length), ie name(20)
+	Columns []string
+
+	Unique   bool
+	FullText bool
+}
+
+// definition returns index definition used by create and alter table
+func (ix Index) definition() string {
+	kind := "KEY"
+	if ix.Unique {
+		kind = "UNIQUE KEY"
+	} else if ix.FullText {
+		kind = "FULLTEXT KEY"
+	}
+	return fmt.Sprintf("%s %s (%s)", kind, ix.Name, strings.Join(ix.Columns, ","))
+}
+
+// sameAs check if ix and other index the same columns the same way
+func (ix Index) sameAs(other Index) bool {
+	if ix.Unique != other.Unique || ix.FullText != other.FullText || len(ix.Columns) != len(other.Columns) {
+		return false
+	}
+	for idx, column := range ix.Columns {
+		if !strings.EqualFold(column, other.Columns[idx]) {
+			return false
+		}
+	}
+	return true
+}
+
+// TableOptions are options of EnsureTableWithOptions
+type TableOptions struct {
+	// Indexes are declared in addition to indexes of struct tags, an index with the same name replaces the tag one
+	Indexes []Index
+
+	// DropStaleIndexes drops secondary indexes which are not declared, otherwise they are only reported
+	DropStaleIndexes bool
+
+	// ForeignKeys are declared in addition to foreign keys of struct tags, ie for composite foreign key
+	ForeignKeys []ForeignKey
+
+	// DropStaleForeignKeys drops FOREIGN KEY constraints which are not declared, otherwise they are only reported
+	DropStaleForeignKeys bool
+
+	// DropColumns drops columns which are not in the struct, otherwise they are only reported
+	DropColumns bool
+
+	// ReorderColumns moves existing columns so their order follows the struct. New columns are always
+	// added after their preceding field
+	ReorderColumns bool
+
+	// Online alters existing table without blocking writes, default is plain ALTER TABLE
+	Online OnlineMode
+
+	// ChunkSize is number of rows copied at a time by shadow table copy, default is 1000
+	ChunkSize int
+
+	// RefuseLossy makes EnsureTableWithOptions fail with ErrLossyChange when the plan has lossy change,
+	// the same as ConfigRefuseLossy of the connection
+	RefuseLossy bool
+
+	// AllowLossy runs lossy changes although RefuseLossy or ConfigRefuseLossy is set
+	AllowLossy bool
+}
+
+// TableResult is result of EnsureTableWithOptions
+type TableResult struct {
+	// Commands are DDL commands that have been run
+	Commands []string
+
+	// StaleIndexes are existing indexes which are not declared
+	StaleIndexes []string
+
+	// StaleForeignKeys are existing FOREIGN KEY constraints which are not declared
+	StaleForeignKeys []string
+
+	// StaleColumns are existing columns which are not in the struct
+	StaleColumns []string
+}
+
+// columnTag is column definition parsed from TagName tag
+type columnTag struct {
+	Type       string
+	NotNull    bool
+	Default    string
+	HasDefault bool
+	AutoInc    bool
+	Comment    string
+	Charset    string
+	Collate    string
+	Length     int
+	Indexes    []Index
+	Reference  string
+	OnDelete   string
+	OnUpdate   string
+	Was        string
+}
+
+func parseColumnTag(tag string) columnTag {
+	ct := columnTag{}
+	for _, item := range strings.Split(tag, ";") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		key, value := item, ""
+		if idx := strings.Index(item, "="); idx >= 0 {
+			key, value = strings.TrimSpace(item[:idx]), strings.TrimSpace(item[idx+1:])
+		}
+
+		key = strings.ToLower(key)
+		switch key {
+		case "type":
+			ct.Type = value
+		case "notnull":
+			ct.NotNull = true
+		case "default":
+			ct.Default = value
+			ct.HasDefault = true
+		case "autoinc":
+			ct.AutoInc = true
+		case "index", "unique", "fulltext":
+			ct.Indexes = append(ct.Indexes, Index{Name: value, Unique: key == "unique", FullText: key == "fulltext"})
+		case "fk":
+			ct.Reference = value
+		case "ondelete":
+			ct.OnDelete = value
+		case "onupdate":
+			ct.OnUpdate = value
+		case "was":
+			ct.Was = value
+		case "length":
+			ct.Length, _ = strconv.Atoi(value)
+		case "comment":
+			ct.Comment = value
+		case "charset":
+			ct.Charset = value
+		case "collate":
+			ct.Collate = value
+		}
+	}
+	return ct
+}
+
+// columnSpec is column of a table derived from a struct field
+type columnSpec struct {
+	Name     string
+	DataType string
+	IsKey    bool
+	Tag      columnTag
+}
+
+// tableColumns returns columns of obj struct, fields with "-" alias are skipped
+func tableColumns(obj interface{}, keys []string, c *Connection) []columnSpec {
+	t := reflect.Indirect(reflect.ValueOf(obj)).Type()
+	columns := []columnSpec{}
+	for idx := 0; idx < t.NumField(); idx++ {
+		ft := t.Field(idx)
+		name := columnName(ft)
+		if name == "-" {
+			continue
+		}
+
+		col := columnSpec{
+			Name:  name,
+			IsKey: codekit.HasMember(keys, name),
+			Tag:   parseColumnTag(ft.Tag.Get(TagName)),
+		}
+		col.DataType = col.Tag.Type
+		if col.DataType == "" {
+			col.DataType = getDataType(ft.Type, c.timeDataType())
+		}
+		columns = append(columns, col)
+	}
+	return columns
+}
+
+// notNull check if column should be created as NOT NULL
+func (col columnSpec) notNull() bool {
+	return col.IsKey || col.Tag.NotNull
+}
+
+// definition returns column definition, without its name and key
+func (col columnSpec) definition() string {
+	def := col.DataType
+	if col.Tag.Charset != "" {
+		def += " CHARACTER SET " + col.Tag.Charset
+	}
+	if col.Tag.Collate != "" {
+		def += " COLLATE " + col.Tag.Collate
+	}
+	if col.notNull() {
+		def += " NOT NULL"
+	}
+	if col.Tag.HasDefault {
+		def += " DEFAULT " + col.Tag.Default
+	}
+	if col.Tag.AutoInc {
+		def += " AUTO_INCREMENT"
+	}
+	if col.Tag.Comment != "" {
+		def += fmt.Sprintf(" COMMENT '%s'", CleanupSQL(col.Tag.Comment))
+	}
+	return def
+}
+
+// tableSpec is table declared by a struct
+type tableSpec struct {
+	Name        string
+	Keys        []string
+	Columns     []columnSpec
+	Indexes     []Index
+	ForeignKeys []ForeignKey
+}
+
+func newTableSpec(name string, keys []string, obj interface{}, opts *TableOptions, c *Connection) *tableSpec {
+	spec := &tableSpec{Name: name, Keys: keys, Columns: tableColumns(obj, keys, c)}
+
+	indexPos := map[string]int{}
+	addIndex := func(ix Index) {
+		if pos, ok := indexPos[strings.ToLower(ix.Name)]; ok {
+			spec.Indexes[pos] = ix
+			return
+		}
+		indexPos[strings.ToLower(ix.Name)] = len(spec.Indexes)
+		spec.Indexes = append(spec.Indexes, ix)
+	}
+
+	for _, col := range spec.Columns {
+		column := col.Name
+		if col.Tag.Length > 0 {
+			column = fmt.Sprintf("%s(%d)", col.Name, col.Tag.Length)
+		}
+		for _, ix := range col.Tag.Indexes {
+			if ix.Name == "" {
+				prefix := "ix_"
+				if ix.Unique {
+					prefix = "uk_"
+				} else if ix.FullText {
+					prefix = "ft_"
+				}
+				ix.Name = prefix + col.Name
+			}
+			if pos, ok := indexPos[strings.ToLower(ix.Name)]; ok {
+				spec.Indexes[pos].Columns = append(spec.Indexes[pos].Columns, column)
+				continue
+			}
+			ix.Columns = []string{column}
+			addIndex(ix)
+		}
+	}
+
+	for _, col := range spec.Columns {
+		if col.Tag.Reference == "" {
+			continue
+		}
+		fk := ForeignKey{
+			Name:     fmt.Sprintf("fk_%s_%s", name, col.Name),
+			Columns:  []string{col.Name},
+			OnDelete: col.Tag.OnDelete,
+			OnUpdate: col.Tag.OnUpdate,
+		}
+		fk.RefTable, fk.RefColumns = parseReference(col.Tag.Reference, col.Name)
+		spec.ForeignKeys = append(spec.ForeignKeys, fk)
+	}
+
+	if opts != nil {
+		for _, ix := range opts.Indexes {
+			addIndex(ix)
+		}
+		spec.ForeignKeys = append(spec.ForeignKeys, opts.ForeignKeys...)
+	}
+	return spec
+}
+
+// tableIndexes reads secondary indexes of table from information_schema.STATISTICS
+func (c *Connection) tableIndexes(ctx context.Context, name string) ([]Index, error) {
+	cmd := "select index_name, non_unique, column_name, sub_part, index_type from information_schema.STATISTICS " +
+		"where table_schema=database() and lower(table_name)=? and index_name<>'PRIMARY' order by index_name, seq_in_index"
+	rows, err := c.db.QueryContext(ctx, cmd, strings.ToLower(name))
+	if err != nil {
+		return nil, fmt.Errorf("unable to read indexes of %s. %s", name, err.Error())
+	}
+	defer rows.Close()
+
+	indexes := []Index{}
+	for rows.Next() {
+		var (
+			indexName, columnName, indexType string
+			nonUnique                        int
+			subPart                          sql.NullInt64
+		)
+		if err = rows.Scan(&indexName, &nonUnique, &columnName, &subPart, &indexType); err != nil {
+			return nil, fmt.Errorf("unable to read indexes of %s. %s", name, err.Error())
+		}
+		if subPart.Valid {
+			columnName = fmt.Sprintf("%s(%d)", columnName, subPart.Int64)
+		}
+		if len(indexes) == 0 || indexes[len(indexes)-1].Name != indexName {
+			indexes = append(indexes, Index{Name: indexName, Unique: nonUnique == 0, FullText: indexType == "FULLTEXT"})
+		}
+		indexes[len(indexes)-1].Columns = append(indexes[len(indexes)-1].Columns, columnName)
+	}
+	return indexes, rows.Err()
+}
+
+// indexChanges adds changes of declared and existing indexes into plan, and reports stale indexes
+func indexChanges(plan *TablePlan, declared, existing []Index, dropStale bool) {
+	existingIndexes := map[string]Index{}
+	for _, ix := range existing {
+		existingIndexes[strings.ToLower(ix.Name)] = ix
+	}
+
+	declaredNames := map[string]bool{}
+	for _, ix := range declared {
+		declaredNames[strings.ToLower(ix.Name)] = true
+		current, exists := existingIndexes[strings.ToLower(ix.Name)]
+		if exists && current.sameAs(ix) {
+			continue
+		}
+		if exists {
+			plan.addChange(ChangeIndexRebuild, fmt.Sprintf("drop index %s, add %s", current.Name, ix.definition()), "rebuild index "+ix.Name, false)
+			continue
+		}
+		plan.addChange(ChangeSafe, "add "+ix.definition(), "add index "+ix.Name, false)
+	}
+
+	for _, ix := range existing {
+		if declaredNames[strings.ToLower(ix.Name)] {
+			continue
+		}
+		plan.StaleIndexes = append(plan.StaleIndexes, ix.Name)
+		if dropStale {
+			plan.addChange(ChangeIndexRebuild, "drop index "+ix.Name, "drop index "+ix.Name, false)
+		}
+	}
+}
+
+func insertName(names []string, idx int, name string) []string {
+	if idx > len(names) {
+		idx = len(names)
+	}
+	names = append(names, "")
+	copy(names[idx+1:], names[idx:])
+	names[idx] = name
+	return names
+}
+
+func removeName(names []string, name string) []string {
+	out := []string{}
+	for _, n := range names {
+		if n != name {
+			out = append(out, n)
+		}
+	}
+	return out
+}